@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"net/http"
+)
+
+const (
+	permRead   = "read"
+	permWrite  = "write"
+	permDelete = "delete"
+)
+
+var errAccessDenied = errors.New("access denied")
+
+// ACLEntry grants permissions on a file to a user or to the members of a
+// group. Write covers uploads, edits and restoring versions; delete covers
+// the trash.
+type ACLEntry struct {
+	User        string   `json:"user,omitempty"`
+	Group       string   `json:"group,omitempty"`
+	Permissions []string `json:"permissions"`
+}
+
+func validateACL(acl []ACLEntry) error {
+	for _, entry := range acl {
+		if (entry.User == "") == (entry.Group == "") {
+			return errors.New("ACL entries need either a user or a group")
+		}
+		for _, perm := range entry.Permissions {
+			if perm != permRead && perm != permWrite && perm != permDelete {
+				return fmt.Errorf("unknown permission: %s", perm)
+			}
+		}
+	}
+	return nil
+}
+
+// isOwner tells whether identity owns file. Files created without
+// authentication have no owner and belong to everyone.
+func isOwner(identity *Identity, file *File) bool {
+	return identity == nil || file.Owner == "" || file.Owner == identity.User
+}
+
+// allowed tells whether identity has perm on file, either as its owner or
+// through its ACL. Everything is allowed without authentication.
+func allowed(identity *Identity, file *File, perm string) bool {
+	if isOwner(identity, file) {
+		return true
+	}
+	for _, entry := range file.ACL {
+		if entry.User != "" && entry.User != identity.User ||
+			entry.Group != "" && !inGroup(identity, entry.Group) {
+			continue
+		}
+		for _, p := range entry.Permissions {
+			if p == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func inGroup(identity *Identity, group string) bool {
+	for _, g := range identity.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize answers 403 unless the caller of request has perm on file.
+func (f FileResource) authorize(request *restful.Request, response *restful.Response, file *File, perm string) bool {
+	if allowed(requestIdentity(request), file, perm) {
+		return true
+	}
+	response.AddHeader("Content-Type", "text/plain")
+	response.WriteErrorString(http.StatusForbidden, "Access denied!")
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// apiKeyAuthenticator accepts the static keys listed in a file, sent in an
+// X-API-Key header. Each line of the file holds a key, the user it stands
+// for and optionally a comma separated list of groups; blank lines and
+// lines starting with # are skipped. Keys are looked up by their hash so
+// that lookups do not leak how much of a key was right.
+type apiKeyAuthenticator struct {
+	keys map[[sha256.Size]byte]*Identity
+}
+
+func newAPIKeyAuthenticator(path string) (*apiKeyAuthenticator, error) {
+	if path == "" {
+		return nil, errors.New("apikey authentication needs -api-keys")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	a := &apiKeyAuthenticator{make(map[[sha256.Size]byte]*Identity)}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected key, user and groups", path, n)
+		}
+		identity := &Identity{User: fields[1]}
+		if len(fields) == 3 {
+			identity.Groups = strings.Split(fields[2], ",")
+		}
+		a.keys[sha256.Sum256([]byte(fields[0]))] = identity
+	}
+	return a, scanner.Err()
+}
+
+func (a *apiKeyAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return nil, nil
+	}
+	identity := a.keys[sha256.Sum256([]byte(key))]
+	if identity == nil {
+		return nil, errors.New("invalid API key")
+	}
+	return identity, nil
+}
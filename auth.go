@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"net/http"
+	"strings"
+)
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	User   string
+	Groups []string
+}
+
+// Authenticator checks the credentials of a request. It returns nil and no
+// error when the request carries no credentials it understands, and an
+// error when it carries invalid ones.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+const identityAttribute = "identity"
+
+func newAuthenticators(kinds string) ([]Authenticator, error) {
+	var authenticators []Authenticator
+	for _, kind := range strings.Split(kinds, ",") {
+		switch strings.TrimSpace(kind) {
+		case "":
+		case "jwt":
+			a, err := newJWTAuthenticator(*jwtHMACKey, *jwtRSAKey)
+			if err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, a)
+		case "apikey":
+			a, err := newAPIKeyAuthenticator(*apiKeys)
+			if err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, a)
+		default:
+			return nil, fmt.Errorf("unknown authenticator: %s", kind)
+		}
+	}
+	return authenticators, nil
+}
+
+// authenticate is the filter that lets requests through only once one of
+// f.authenticators has identified the caller, and records the identity on
+// the request. Downloads with a signed link are checked by the handler
+// instead.
+func (f FileResource) authenticate(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+	if signedDownload(request) {
+		chain.ProcessFilter(request, response)
+		return
+	}
+	for _, a := range f.authenticators {
+		identity, err := a.Authenticate(request.Request)
+		if err != nil {
+			response.AddHeader("WWW-Authenticate", `Bearer error="invalid_token"`)
+			response.AddHeader("Content-Type", "text/plain")
+			response.WriteErrorString(http.StatusUnauthorized, err.Error())
+			return
+		}
+		if identity != nil {
+			request.SetAttribute(identityAttribute, identity)
+			chain.ProcessFilter(request, response)
+			return
+		}
+	}
+	response.AddHeader("WWW-Authenticate", "Bearer")
+	response.AddHeader("Content-Type", "text/plain")
+	response.WriteErrorString(http.StatusUnauthorized, "Authentication required!")
+}
+
+// requestIdentity is the caller of request, or nil when authentication is
+// disabled.
+func requestIdentity(request *restful.Request) *Identity {
+	identity, _ := request.Attribute(identityAttribute).(*Identity)
+	return identity
+}
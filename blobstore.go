@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+// BlobStore holds the contents of files. The location returned by Assign is
+// what gets recorded in File.Url and handed back to the other methods.
+type BlobStore interface {
+	Assign(id string) (string, error)
+	Put(location string, name string, r io.Reader) error
+	Get(location string) (*Blob, error)
+	Delete(location string) error
+	Stat(location string) (*BlobInfo, error)
+}
+
+// RangeGetter is implemented by blob stores that can read part of a blob
+// without fetching the whole of it. A negative length reads to the end.
+type RangeGetter interface {
+	GetRange(location string, offset, length int64) (*Blob, error)
+}
+
+// ExpiringAssigner is implemented by blob stores that can delete blobs by
+// themselves once their TTL, given in the format of parseTTL, has passed.
+type ExpiringAssigner interface {
+	AssignTTL(id, ttl string) (string, error)
+}
+
+// DirectLinker is implemented by blob stores whose blobs clients can fetch
+// themselves. DirectURL returns a URL valid for at least ttl and whether it
+// stops working after that; header holds response headers, such as
+// Content-Disposition, that the store should send if it can.
+type DirectLinker interface {
+	DirectURL(location string, ttl time.Duration, header http.Header) (string, bool, error)
+}
+
+type BlobInfo struct {
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+type Blob struct {
+	BlobInfo
+	io.ReadCloser
+}
+
+// getRange reads part of a blob, natively if the store supports it and by
+// skipping over the start of the blob otherwise.
+func getRange(blobs BlobStore, location string, offset, length int64) (*Blob, error) {
+	if ranged, ok := blobs.(RangeGetter); ok {
+		return ranged.GetRange(location, offset, length)
+	}
+	blob, err := blobs.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	return cutBlob(blob, offset, length)
+}
+
+// cutBlob turns a whole blob into the range of it starting at offset.
+func cutBlob(blob *Blob, offset, length int64) (*Blob, error) {
+	_, err := io.CopyN(ioutil.Discard, blob, offset)
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+	if length >= 0 {
+		blob.ReadCloser = readCloser{io.LimitReader(blob.ReadCloser, length), blob.ReadCloser}
+	}
+	return blob, nil
+}
+
+func newBlobStore(kind string) (BlobStore, error) {
+	switch kind {
+	case "weed":
+		return newWeedStore(*weedUrl), nil
+	case "local":
+		return newLocalStore(*localDir)
+	case "s3":
+		return newS3Store(*s3Endpoint, *s3Region, *s3Bucket, *s3AccessKey, *s3SecretKey, *s3PartSize)
+	case "memory":
+		return newMemoryBlobStore(), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend: %s", kind)
+}
+
+type memoryBlob struct {
+	data    []byte
+	name    string
+	modTime time.Time
+}
+
+// memoryBlobStore keeps blobs in process memory. It is meant for tests and
+// for trying the plugin out without any storage cluster.
+type memoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string]*memoryBlob
+}
+
+func newMemoryBlobStore() *memoryBlobStore {
+	return &memoryBlobStore{blobs: make(map[string]*memoryBlob)}
+}
+
+func (s *memoryBlobStore) Assign(id string) (string, error) {
+	return "memory:" + id, nil
+}
+
+func (s *memoryBlobStore) Put(location string, name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.blobs[location] = &memoryBlob{data, name, time.Now()}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryBlobStore) Get(location string) (*Blob, error) {
+	s.mu.RLock()
+	b, ok := s.blobs[location]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, errBlobNotFound
+	}
+	return &Blob{b.info(), ioutil.NopCloser(bytes.NewReader(b.data))}, nil
+}
+
+func (s *memoryBlobStore) GetRange(location string, offset, length int64) (*Blob, error) {
+	s.mu.RLock()
+	b, ok := s.blobs[location]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, errBlobNotFound
+	}
+	data := b.data
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return &Blob{b.info(), ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (s *memoryBlobStore) Delete(location string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blobs[location]; !ok {
+		return errBlobNotFound
+	}
+	delete(s.blobs, location)
+	return nil
+}
+
+func (s *memoryBlobStore) Stat(location string) (*BlobInfo, error) {
+	s.mu.RLock()
+	b, ok := s.blobs[location]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, errBlobNotFound
+	}
+	info := b.info()
+	return &info, nil
+}
+
+func (b *memoryBlob) info() BlobInfo {
+	return BlobInfo{int64(len(b.data)), http.DetectContentType(b.data), b.modTime}
+}
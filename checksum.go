@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var errDigestMismatch = errors.New("checksum mismatch")
+
+// parseDigests collects the digests a client sent for an upload, from a
+// Content-MD5 header and from RFC 3230 Digest headers. The result maps the
+// lower-cased algorithm name to the raw digest. Unknown algorithms are
+// ignored.
+func parseDigests(header http.Header) (map[string][]byte, error) {
+	expected := make(map[string][]byte)
+	if value := header.Get("Content-MD5"); value != "" {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Content-MD5: %v", err)
+		}
+		expected["md5"] = sum
+	}
+	for _, value := range header["Digest"] {
+		for _, item := range strings.Split(value, ",") {
+			parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid Digest: %s", item)
+			}
+			alg := strings.ToLower(parts[0])
+			if alg != "md5" && alg != "sha-256" {
+				continue
+			}
+			sum, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid Digest: %v", err)
+			}
+			expected[alg] = sum
+		}
+	}
+	return expected, nil
+}
+
+// verifyDigests checks the digests computed while storing fileInfo against
+// those from parseDigests.
+func verifyDigests(fileInfo *File, expected map[string][]byte) error {
+	actual := map[string]string{"md5": fileInfo.Md5, "sha-256": fileInfo.Sha256}
+	for alg, sum := range expected {
+		computed, err := hex.DecodeString(actual[alg])
+		if err != nil || !bytes.Equal(computed, sum) {
+			return errDigestMismatch
+		}
+	}
+	return nil
+}
+
+// setDigestHeaders advertises the stored digests of a file on a download.
+func setDigestHeaders(header http.Header, file *File) {
+	if file.Sha256 == "" {
+		return
+	}
+	header.Set("ETag", `"`+file.Sha256+`"`)
+	var digests []string
+	if sum, err := hex.DecodeString(file.Sha256); err == nil {
+		digests = append(digests, "sha-256="+base64.StdEncoding.EncodeToString(sum))
+	}
+	if sum, err := hex.DecodeString(file.Md5); err == nil && len(sum) == md5.Size {
+		digests = append(digests, "md5="+base64.StdEncoding.EncodeToString(sum))
+	}
+	header.Set("Digest", strings.Join(digests, ","))
+}
+
+// discardContent removes the stored content of a file whose upload was
+// rejected after it had been written.
+func (f *FileResource) discardContent(fileInfo *File) {
+	if len(fileInfo.Chunks) > 0 {
+		f.deleteChunks(fileInfo.Chunks, "")
+	} else {
+		err := f.blobs.Delete(fileInfo.Url)
+		if err != nil && err != errBlobNotFound {
+			log.Printf("deleting %s: %v", fileInfo.Url, err)
+		}
+	}
+	fileInfo.Chunks = nil
+	fileInfo.Size = 0
+	fileInfo.Sha256 = ""
+	fileInfo.Md5 = ""
+}
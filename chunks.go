@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/pborman/uuid"
+	"io"
+	"log"
+	"os"
+)
+
+// Chunk is one piece of a file that was too large to be kept as a single
+// blob. Chunks are listed in order and Offset is where the chunk starts
+// within the file.
+type Chunk struct {
+	Url    string `json:"url"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// storeContent writes r to the blob store and records its size, digests and
+// sniffed content type on fileInfo. When chunking is enabled and r turns out to be larger than
+// one chunk, it is split into chunks of f.chunkSize, the first kept at
+// fileInfo.Url and the others at locations of their own, and the manifest is
+// recorded in fileInfo.Chunks.
+func (f *FileResource) storeContent(fileInfo *File, name string, r io.Reader) error {
+	base := fileInfo.Id
+	if hasContent(fileInfo) {
+		// The current content becomes a past version, and may be shared
+		// with other files, so it is never overwritten.
+		base = uuid.New()
+		location, err := f.assign(fileInfo, base)
+		if err != nil {
+			return err
+		}
+		fileInfo.Url = location
+	}
+	var chunks []Chunk
+	var offset int64
+	sha := sha256.New()
+	md := md5.New()
+	head := &headWriter{limit: sniffLen}
+	reader := bufio.NewReader(io.TeeReader(r, io.MultiWriter(sha, md, head)))
+	for n := 0; ; n++ {
+		location := fileInfo.Url
+		if n > 0 {
+			var err error
+			location, err = f.assign(fileInfo, fmt.Sprintf("%s-%d", base, n))
+			if err != nil {
+				f.deleteChunks(chunks, fileInfo.Url)
+				return err
+			}
+		}
+		var size int64
+		var chunk io.Reader = reader
+		if f.chunkSize > 0 {
+			chunk = io.LimitReader(reader, f.chunkSize)
+		}
+		err := f.blobs.Put(location, name, &countingReader{chunk, &size})
+		if err != nil {
+			f.deleteChunks(chunks, fileInfo.Url)
+			return err
+		}
+		chunks = append(chunks, Chunk{location, offset, size})
+		offset += size
+		if f.chunkSize <= 0 {
+			break
+		}
+		_, err = reader.Peek(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.deleteChunks(chunks, fileInfo.Url)
+			return err
+		}
+	}
+
+	fileInfo.Size = offset
+	fileInfo.Sha256 = hex.EncodeToString(sha.Sum(nil))
+	fileInfo.Md5 = hex.EncodeToString(md.Sum(nil))
+	fileInfo.ContentType = detectContentType(name, head.buf)
+	fileInfo.Chunks = nil
+	if len(chunks) > 1 {
+		fileInfo.Chunks = chunks
+	}
+	return nil
+}
+
+// deleteChunks removes the blobs of chunks, except the one at keep, logging
+// failures since there is nobody to report them to.
+func (f *FileResource) deleteChunks(chunks []Chunk, keep string) {
+	for _, c := range chunks {
+		if c.Url == keep {
+			continue
+		}
+		err := f.blobs.Delete(c.Url)
+		if err != nil && err != errBlobNotFound {
+			log.Printf("deleting chunk %s: %v", c.Url, err)
+		}
+	}
+}
+
+// chunkReader reads a chunked file as one stream. It is seekable so that
+// http.ServeContent can answer Range requests, opening only the chunks a
+// range touches and reading them from the right offset.
+type chunkReader struct {
+	blobs   BlobStore
+	chunks  []Chunk
+	size    int64
+	offset  int64
+	current io.ReadCloser
+	at      int64
+	end     int64
+}
+
+func newChunkReader(blobs BlobStore, chunks []Chunk) *chunkReader {
+	r := &chunkReader{blobs: blobs, chunks: chunks}
+	if len(chunks) > 0 {
+		last := chunks[len(chunks)-1]
+		r.size = last.Offset + last.Size
+	}
+	return r
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.current != nil && r.at != r.offset {
+		r.current.Close()
+		r.current = nil
+	}
+	if r.current == nil {
+		err := r.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > r.end-r.offset {
+		p = p[:r.end-r.offset]
+	}
+	n, err := r.current.Read(p)
+	r.offset += int64(n)
+	r.at = r.offset
+	if r.offset == r.end {
+		r.current.Close()
+		r.current = nil
+		return n, nil
+	}
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *chunkReader) open() error {
+	for _, c := range r.chunks {
+		if r.offset >= c.Offset && r.offset < c.Offset+c.Size {
+			start := r.offset - c.Offset
+			blob, err := getRange(r.blobs, c.Url, start, c.Size-start)
+			if err != nil {
+				return err
+			}
+			r.current = blob
+			r.at = r.offset
+			r.end = c.Offset + c.Size
+			return nil
+		}
+	}
+	return fmt.Errorf("no chunk at offset %d", r.offset)
+}
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_CUR:
+		offset += r.offset
+	case os.SEEK_END:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	// The open stream is only dropped by a read elsewhere, so seeking to
+	// the end for the size and back costs nothing.
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		r.current.Close()
+		r.current = nil
+	}
+	return nil
+}
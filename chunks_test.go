@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// countingBlobStore counts the reads of the memory blob store it wraps.
+type countingBlobStore struct {
+	*memoryBlobStore
+	mu    sync.Mutex
+	reads int
+}
+
+func (s *countingBlobStore) GetRange(location string, offset, length int64) (*Blob, error) {
+	s.mu.Lock()
+	s.reads++
+	s.mu.Unlock()
+	return s.memoryBlobStore.GetRange(location, offset, length)
+}
+
+func (s *countingBlobStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reads := s.reads
+	s.reads = 0
+	return reads
+}
+
+func TestDownloadReads(t *testing.T) {
+	f, cleanup := newTestResource(t)
+	defer cleanup()
+	blobs := &countingBlobStore{memoryBlobStore: newMemoryBlobStore()}
+	f.blobs = blobs
+	srv := newTestServer(f)
+	defer srv.Close()
+
+	blobs.Put("whole", "a.txt", strings.NewReader("hello world"))
+	blobs.Put("c1", "b.txt", strings.NewReader("hello "))
+	blobs.Put("c2", "b.txt", strings.NewReader("world"))
+	f.meta.Put(&File{Id: "single", Name: "a.txt", Status: "uploaded", Url: "whole", Size: 11, Sha256: "abc"})
+	f.meta.Put(&File{Id: "chunked", Name: "b.txt", Status: "uploaded", Size: 11, Sha256: "def",
+		Chunks: []Chunk{{Url: "c1", Offset: 0, Size: 6}, {Url: "c2", Offset: 6, Size: 5}}})
+
+	for _, c := range []struct {
+		id, ranges, body string
+		reads            int
+	}{
+		{"single", "", "hello world", 1},
+		{"single", "bytes=6-", "world", 1},
+		{"chunked", "", "hello world", 2},
+		{"chunked", "bytes=2-3", "ll", 1},
+		{"chunked", "bytes=4-7", "o wo", 2},
+	} {
+		req, _ := http.NewRequest("GET", srv.URL+"/files/"+c.id+"/download", nil)
+		if c.ranges != "" {
+			req.Header.Set("Range", c.ranges)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != c.body {
+			t.Errorf("%s %q: body %q", c.id, c.ranges, body)
+		}
+		if reads := blobs.count(); reads != c.reads {
+			t.Errorf("%s %q: %d reads, want %d", c.id, c.ranges, reads, c.reads)
+		}
+	}
+}
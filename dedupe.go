@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+)
+
+// Files with identical content share one blob. Every file whose content is
+// a single blob holds a reference to it in the metadata store, keyed by the
+// SHA-256 of the content, and the blob is deleted when the last reference
+// is released. Chunked content and the content of expiring files are never
+// shared.
+
+// shareContent points fileInfo at the blob already holding the same
+// content, if there is one, dropping the copy just uploaded, and counts the
+// reference fileInfo holds.
+func (f *FileResource) shareContent(fileInfo *File) error {
+	if len(fileInfo.Chunks) > 0 || fileInfo.Sha256 == "" || fileInfo.Expires != nil {
+		return nil
+	}
+	location, err := f.meta.AddRef(fileInfo.Sha256, fileInfo.Url)
+	if err != nil {
+		return err
+	}
+	if location != fileInfo.Url {
+		err = f.blobs.Delete(fileInfo.Url)
+		if err != nil && err != errBlobNotFound {
+			log.Printf("deleting duplicate %s: %v", fileInfo.Url, err)
+		}
+		fileInfo.Url = location
+	}
+	return nil
+}
+
+// releaseContent drops the content of a file that is gone, deleting the
+// blob once no other file uses it. Content that was never shared, stored
+// before checksums existed or for an expiring file, is deleted outright.
+func (f *FileResource) releaseContent(file *File) {
+	if len(file.Chunks) > 0 {
+		f.deleteChunks(file.Chunks, "")
+		return
+	}
+	location := file.Url
+	if file.Sha256 != "" && file.Expires == nil {
+		released, remaining, err := f.meta.Release(file.Sha256)
+		if err != nil {
+			log.Printf("releasing %s: %v", file.Sha256, err)
+			return
+		}
+		if remaining > 0 {
+			return
+		}
+		// Content stored before deduplication has no reference; only file
+		// refers to it.
+		if released != "" {
+			location = released
+		}
+	}
+	err := f.blobs.Delete(location)
+	if err != nil && err != errBlobNotFound {
+		log.Printf("deleting %s: %v", location, err)
+	}
+}
+
+// deleteContent drops the content of a file that is being deleted, past
+// versions included.
+func (f *FileResource) deleteContent(file *File) {
+	f.dropVersions(file, file.Versions)
+	f.releaseContent(file)
+}
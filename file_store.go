@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type fileStoreEntry struct {
+	Op    string          `json:"op"`
+	Id    string          `json:"id"`
+	File  json.RawMessage `json:"file,omitempty"`
+	Ref   *blobRef        `json:"ref,omitempty"`
+	Share json.RawMessage `json:"share,omitempty"`
+}
+
+// fileStore is an embedded store that needs no server. Records live in
+// memory and every change is appended to a log file, which is replayed on
+// startup and compacted once it holds many more entries than records.
+type fileStore struct {
+	*memoryStore
+	path    string
+	mu      sync.Mutex
+	log     *os.File
+	entries int
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	s := &fileStore{memoryStore: newMemoryStore(), path: path}
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	err = s.compact()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileStore) Put(file *File) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.putLocked(file)
+}
+
+func (s *fileStore) putLocked(file *File) error {
+	serialized, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	err = s.appendLocked(fileStoreEntry{Op: "put", Id: file.Id, File: serialized})
+	if err != nil {
+		return err
+	}
+	err = s.memoryStore.Put(file)
+	s.maybeCompactLocked()
+	return err
+}
+
+func (s *fileStore) Update(id string, fn func(*File) error) (*File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := s.memoryStore.Get(id)
+	if err != nil || file == nil {
+		return nil, err
+	}
+	err = fn(file)
+	if err != nil {
+		return nil, err
+	}
+	err = s.putLocked(file)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *fileStore) Delete(id string) (*File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := s.memoryStore.Get(id)
+	if err != nil || file == nil {
+		return nil, err
+	}
+	err = s.appendLocked(fileStoreEntry{Op: "delete", Id: id})
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.memoryStore.Delete(id)
+	s.maybeCompactLocked()
+	return file, err
+}
+
+func (s *fileStore) AddRef(hash, location string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref := s.ref(hash)
+	if ref.Count == 0 {
+		ref.Location = location
+	}
+	ref.Count++
+	err := s.setRefLocked(hash, ref)
+	if err != nil {
+		return "", err
+	}
+	return ref.Location, nil
+}
+
+func (s *fileStore) Release(hash string) (string, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref := s.ref(hash)
+	if ref.Count == 0 {
+		return "", 0, nil
+	}
+	ref.Count--
+	err := s.setRefLocked(hash, ref)
+	if err != nil {
+		return "", 0, err
+	}
+	return ref.Location, ref.Count, nil
+}
+
+func (s *fileStore) PutShare(share *Share) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.putShareLocked(share)
+}
+
+func (s *fileStore) putShareLocked(share *Share) error {
+	serialized, err := json.Marshal(share)
+	if err != nil {
+		return err
+	}
+	err = s.appendLocked(fileStoreEntry{Op: "share", Id: share.Token, Share: serialized})
+	if err != nil {
+		return err
+	}
+	err = s.memoryStore.PutShare(share)
+	s.maybeCompactLocked()
+	return err
+}
+
+func (s *fileStore) UpdateShare(token string, fn func(*Share) error) (*Share, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	share, err := s.memoryStore.GetShare(token)
+	if err != nil || share == nil {
+		return nil, err
+	}
+	err = fn(share)
+	if err != nil {
+		return nil, err
+	}
+	err = s.putShareLocked(share)
+	if err != nil {
+		return nil, err
+	}
+	return share, nil
+}
+
+func (s *fileStore) DeleteShare(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.appendLocked(fileStoreEntry{Op: "unshare", Id: token})
+	if err != nil {
+		return err
+	}
+	err = s.memoryStore.DeleteShare(token)
+	s.maybeCompactLocked()
+	return err
+}
+
+func (s *fileStore) ref(hash string) blobRef {
+	s.memoryStore.mu.RLock()
+	defer s.memoryStore.mu.RUnlock()
+	if ref := s.refs[hash]; ref != nil {
+		return *ref
+	}
+	return blobRef{}
+}
+
+func (s *fileStore) setRefLocked(hash string, ref blobRef) error {
+	err := s.appendLocked(fileStoreEntry{Op: "ref", Id: hash, Ref: &ref})
+	if err != nil {
+		return err
+	}
+	s.memoryStore.mu.Lock()
+	s.setRef(hash, ref)
+	s.memoryStore.mu.Unlock()
+	s.maybeCompactLocked()
+	return nil
+}
+
+func (s *fileStore) setRef(hash string, ref blobRef) {
+	if ref.Count > 0 {
+		s.refs[hash] = &ref
+	} else {
+		delete(s.refs, hash)
+	}
+}
+
+// appendLocked writes entry to the log. The log is appended to before the
+// in-memory record changes, and s.mu is held across both so that the log
+// order matches the order in which changes were applied.
+func (s *fileStore) appendLocked(entry fileStoreEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = s.log.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	s.entries++
+	return nil
+}
+
+func (s *fileStore) maybeCompactLocked() {
+	s.memoryStore.mu.RLock()
+	live := len(s.records) + len(s.refs) + len(s.shares)
+	s.memoryStore.mu.RUnlock()
+	if s.entries > 1000 && s.entries > 4*live {
+		err := s.compactLocked()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (s *fileStore) load() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	// Only the last line may be bad, torn by a crash mid-write; compaction
+	// drops it. A bad line anywhere else means the log is damaged.
+	var bad error
+	line := 0
+	for scanner.Scan() {
+		if bad != nil {
+			return fmt.Errorf("%s:%d: bad entry: %v", s.path, line, bad)
+		}
+		line++
+		var entry fileStoreEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			bad = err
+			continue
+		}
+		switch entry.Op {
+		case "put":
+			s.records[entry.Id] = []byte(entry.File)
+		case "delete":
+			delete(s.records, entry.Id)
+		case "ref":
+			if entry.Ref != nil {
+				s.setRef(entry.Id, *entry.Ref)
+			}
+		case "share":
+			s.shares[entry.Id] = []byte(entry.Share)
+		case "unshare":
+			delete(s.shares, entry.Id)
+		}
+	}
+	if bad != nil {
+		log.Printf("%s:%d: dropping torn last entry: %v", s.path, line, bad)
+	}
+	return scanner.Err()
+}
+
+func (s *fileStore) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compactLocked()
+}
+
+// compactLocked rewrites the log with one entry per record, blob reference
+// and share, replacing the old log atomically, and reopens it for appending.
+func (s *fileStore) compactLocked() error {
+	dir := filepath.Dir(s.path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".compact-")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	s.memoryStore.mu.RLock()
+	entries := 0
+	for id, serialized := range s.records {
+		line, err := json.Marshal(fileStoreEntry{Op: "put", Id: id, File: serialized})
+		if err == nil {
+			_, err = writer.Write(append(line, '\n'))
+		}
+		if err != nil {
+			s.memoryStore.mu.RUnlock()
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		entries++
+	}
+	for hash, ref := range s.refs {
+		line, err := json.Marshal(fileStoreEntry{Op: "ref", Id: hash, Ref: ref})
+		if err == nil {
+			_, err = writer.Write(append(line, '\n'))
+		}
+		if err != nil {
+			s.memoryStore.mu.RUnlock()
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		entries++
+	}
+	for token, serialized := range s.shares {
+		line, err := json.Marshal(fileStoreEntry{Op: "share", Id: token, Share: serialized})
+		if err == nil {
+			_, err = writer.Write(append(line, '\n'))
+		}
+		if err != nil {
+			s.memoryStore.mu.RUnlock()
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		entries++
+	}
+	s.memoryStore.mu.RUnlock()
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if s.log != nil {
+		s.log.Close()
+	}
+	s.log, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.entries = entries
+	return nil
+}
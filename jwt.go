@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// jwtLeeway is the clock skew tolerated when checking token times.
+const jwtLeeway = 30 * time.Second
+
+var errInvalidToken = errors.New("invalid token")
+
+// jwtAuthenticator accepts bearer JSON Web Tokens signed with HS256 by a
+// shared key or with RS256 by the private half of a public key. The user is
+// the "sub" claim and the groups are the "groups" claim.
+type jwtAuthenticator struct {
+	hmacKey []byte
+	rsaKey  *rsa.PublicKey
+}
+
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Groups    []string `json:"groups"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+}
+
+func newJWTAuthenticator(hmacKey, rsaKeyFile string) (*jwtAuthenticator, error) {
+	a := &jwtAuthenticator{}
+	if hmacKey != "" {
+		a.hmacKey = []byte(hmacKey)
+	}
+	if rsaKeyFile != "" {
+		data, err := ioutil.ReadFile(rsaKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PEM data in " + rsaKeyFile)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		a.rsaKey, ok = key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("not an RSA public key: " + rsaKeyFile)
+		}
+	}
+	if a.hmacKey == nil && a.rsaKey == nil {
+		return nil, errors.New("jwt authentication needs -jwt-hmac-key or -jwt-rsa-key")
+	}
+	return a, nil
+}
+
+func (a *jwtAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, nil
+	}
+	claims, err := a.verify(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{User: claims.Subject, Groups: claims.Groups}, nil
+}
+
+func (a *jwtAuthenticator) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case header.Alg == "HS256" && a.hmacKey != nil:
+		mac := hmac.New(sha256.New, a.hmacKey)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, errInvalidToken
+		}
+	case header.Alg == "RS256" && a.rsaKey != nil:
+		sum := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(a.rsaKey, crypto.SHA256, sum[:], signature) != nil {
+			return nil, errInvalidToken
+		}
+	default:
+		return nil, errors.New("unsupported token algorithm: " + header.Alg)
+	}
+
+	var claims jwtClaims
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil || claims.Subject == "" {
+		return nil, errInvalidToken
+	}
+	now := time.Now()
+	if claims.ExpiresAt != 0 && now.After(time.Unix(claims.ExpiresAt, 0).Add(jwtLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now.Add(jwtLeeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	return &claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
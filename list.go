@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/emicklei/go-restful"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 1000
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// ListQuery selects a page of files. Files must carry all of Tags and all
+// of Attributes. Files in the trash are only listed with Trashed, and
+// DeletedBefore further limits those to files deleted before then.
+// ExpiredBefore lists the files that expired before then, whether they are
+// in the trash or not. Reader, when set, limits the files to those it may
+// read. Sort is "created" or "name", with a leading "-" for
+// descending order. Cursor is the Next value of the previous page.
+type ListQuery struct {
+	Status        string
+	Prefix        string
+	Owner         string
+	Tags          []string
+	Attributes    map[string]string
+	Trashed       bool
+	DeletedBefore time.Time
+	ExpiredBefore time.Time
+	Reader        *Identity
+	Sort          string
+	Cursor        string
+	Limit         int
+}
+
+type FileList struct {
+	Files []*File `json:"files"`
+	Next  string  `json:"next,omitempty"`
+}
+
+type listCursor struct {
+	Created int64  `json:"c,omitempty"`
+	Name    string `json:"n,omitempty"`
+	Id      string `json:"i"`
+}
+
+func (q *ListQuery) matches(file *File) bool {
+	if q.ExpiredBefore.IsZero() && (file.Deleted != nil) != q.Trashed ||
+		!q.ExpiredBefore.IsZero() && (file.Expires == nil || !file.Expires.Before(q.ExpiredBefore)) ||
+		!q.DeletedBefore.IsZero() && (file.Deleted == nil || !file.Deleted.Before(q.DeletedBefore)) ||
+		q.Status != "" && file.Status != q.Status ||
+		q.Owner != "" && file.Owner != q.Owner ||
+		!strings.HasPrefix(file.Name, q.Prefix) {
+		return false
+	}
+	if !allowed(q.Reader, file, permRead) {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !hasTag(file, tag) {
+			return false
+		}
+	}
+	for key, value := range q.Attributes {
+		if actual, ok := file.Attributes[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+func hasTag(file *File, tag string) bool {
+	for _, t := range file.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeTags trims tags and drops empty and repeated ones.
+func normalizeTags(tags []string) []string {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+func (q *ListQuery) byName() bool {
+	return strings.TrimPrefix(q.Sort, "-") == "name"
+}
+
+// less orders files by the sort key of q, ties broken by id.
+func (q *ListQuery) less(a, b listCursor) bool {
+	if strings.HasPrefix(q.Sort, "-") {
+		a, b = b, a
+	}
+	if q.byName() {
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+	} else if a.Created != b.Created {
+		return a.Created < b.Created
+	}
+	return a.Id < b.Id
+}
+
+func (q *ListQuery) key(file *File) listCursor {
+	if q.byName() {
+		return listCursor{Name: file.Name, Id: file.Id}
+	}
+	return listCursor{Created: file.Created.UnixNano(), Id: file.Id}
+}
+
+// after decodes the cursor of q, which is nil for the first page.
+func (q *ListQuery) after() (*listCursor, error) {
+	if q.Cursor == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	after := new(listCursor)
+	err = json.Unmarshal(raw, after)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	return after, nil
+}
+
+func (q *ListQuery) limit() int {
+	if q.Limit <= 0 {
+		return defaultListLimit
+	}
+	return q.Limit
+}
+
+// pageFiles filters, sorts and pages candidate records. Stores use their
+// indexes to narrow down the candidates; records that no longer match the
+// query are dropped here.
+func pageFiles(files []*File, q *ListQuery) (*FileList, error) {
+	after, err := q.after()
+	if err != nil {
+		return nil, err
+	}
+	var matched []*File
+	for _, file := range files {
+		if file != nil && q.matches(file) && (after == nil || q.less(*after, q.key(file))) {
+			matched = append(matched, file)
+		}
+	}
+	sort.Sort(filesByQuery{matched, q})
+
+	limit := q.limit()
+	list := &FileList{Files: matched}
+	if len(matched) > limit {
+		list.Files = matched[:limit]
+		next, err := json.Marshal(q.key(matched[limit-1]))
+		if err != nil {
+			return nil, err
+		}
+		list.Next = base64.RawURLEncoding.EncodeToString(next)
+	}
+	if list.Files == nil {
+		list.Files = []*File{}
+	}
+	return list, nil
+}
+
+type filesByQuery struct {
+	files []*File
+	q     *ListQuery
+}
+
+func (s filesByQuery) Len() int { return len(s.files) }
+func (s filesByQuery) Less(i, j int) bool {
+	return s.q.less(s.q.key(s.files[i]), s.q.key(s.files[j]))
+}
+func (s filesByQuery) Swap(i, j int) { s.files[i], s.files[j] = s.files[j], s.files[i] }
+
+func (f FileResource) listFiles(request *restful.Request, response *restful.Response) {
+	q := &ListQuery{
+		Status: request.QueryParameter("status"),
+		Prefix: request.QueryParameter("prefix"),
+		Owner:  request.QueryParameter("owner"),
+		Sort:   request.QueryParameter("sort"),
+		Cursor: request.QueryParameter("cursor"),
+		Reader: requestIdentity(request),
+	}
+	q.Trashed, _ = strconv.ParseBool(request.QueryParameter("trashed"))
+	for key, values := range request.Request.URL.Query() {
+		switch {
+		case key == "tag":
+			q.Tags = normalizeTags(values)
+		case strings.HasPrefix(key, "attr."):
+			if q.Attributes == nil {
+				q.Attributes = make(map[string]string)
+			}
+			q.Attributes[strings.TrimPrefix(key, "attr.")] = values[0]
+		}
+	}
+	if q.Sort == "" {
+		q.Sort = "created"
+	}
+	if key := strings.TrimPrefix(q.Sort, "-"); key != "created" && key != "name" {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusBadRequest, "Invalid sort!")
+		return
+	}
+	if limit := request.QueryParameter("limit"); limit != "" {
+		var err error
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil || q.Limit <= 0 || q.Limit > maxListLimit {
+			response.AddHeader("Content-Type", "text/plain")
+			response.WriteErrorString(http.StatusBadRequest, "Invalid limit!")
+			return
+		}
+	}
+	list, err := f.meta.List(q)
+	if err == errInvalidCursor {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusBadRequest, "Invalid cursor!")
+		return
+	}
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	response.WriteEntity(list)
+}
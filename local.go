@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// localStore keeps blobs as plain files under a directory on local disk,
+// sharded into two levels of subdirectories by the first characters of the
+// file id so that no single directory grows too large.
+type localStore struct {
+	dir string
+}
+
+func newLocalStore(dir string) (*localStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &localStore{dir}, nil
+}
+
+func (s *localStore) Assign(id string) (string, error) {
+	if len(id) < 4 || strings.ContainsAny(id, `/\.`) {
+		return "", errors.New("local: invalid id " + id)
+	}
+	return "local:" + id[0:2] + "/" + id[2:4] + "/" + id, nil
+}
+
+func (s *localStore) Put(location string, name string, r io.Reader) error {
+	path, err := s.path(location)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s *localStore) Get(location string) (*Blob, error) {
+	path, err := s.path(location)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := localBlobInfo(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Blob{*info, file}, nil
+}
+
+func (s *localStore) GetRange(location string, offset, length int64) (*Blob, error) {
+	blob, err := s.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	file := blob.ReadCloser.(*os.File)
+	_, err = file.Seek(offset, 0)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if length >= 0 {
+		blob.ReadCloser = readCloser{io.LimitReader(file, length), file}
+	}
+	return blob, nil
+}
+
+func (s *localStore) Delete(location string) error {
+	path, err := s.path(location)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return errBlobNotFound
+	}
+	return err
+}
+
+func (s *localStore) Stat(location string) (*BlobInfo, error) {
+	path, err := s.path(location)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return localBlobInfo(file)
+}
+
+func (s *localStore) path(location string) (string, error) {
+	if !strings.HasPrefix(location, "local:") {
+		return "", errors.New("local: unsupported location " + location)
+	}
+	rel := filepath.FromSlash(strings.TrimPrefix(location, "local:"))
+	if filepath.IsAbs(rel) || rel != filepath.Clean(rel) || strings.HasPrefix(rel, "..") {
+		return "", errors.New("local: invalid location " + location)
+	}
+	return filepath.Join(s.dir, rel), nil
+}
+
+// localBlobInfo stats an open file and sniffs its content type, leaving the
+// read offset at the start of the file.
+func localBlobInfo(file *os.File) (*BlobInfo, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobInfo{stat.Size(), http.DetectContentType(head[:n]), stat.ModTime()}, nil
+}
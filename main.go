@@ -1,34 +1,68 @@
 package main
 
 import (
-	"github.com/pborman/uuid"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/emicklei/go-restful"
-	"github.com/garyburd/redigo/redis"
 	"github.com/liuyang1204/go-progress"
+	"github.com/pborman/uuid"
 	"io"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"mime/multipart"
+	"net/http"
 	"os"
-	"time"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type File struct {
-	Id   string `json:"id"`
-	Name string `json:"name"`
-	Status string `json:"status"`
-	Progress float32 `json:"progress"`
-	Url string `json:"url"`
+	Id           string            `json:"id"`
+	Name         string            `json:"name"`
+	Status       string            `json:"status"`
+	Progress     float32           `json:"progress"`
+	Url          string            `json:"url"`
+	Size         int64             `json:"size,omitempty"`
+	Offset       int64             `json:"offset,omitempty"`
+	UploadLength int64             `json:"uploadLength,omitempty"`
+	Chunks       []Chunk           `json:"chunks,omitempty"`
+	Sha256       string            `json:"sha256,omitempty"`
+	Md5          string            `json:"md5,omitempty"`
+	Owner        string            `json:"owner,omitempty"`
+	ACL          []ACLEntry        `json:"acl,omitempty"`
+	Created      time.Time         `json:"created"`
+	ContentType  string            `json:"contentType,omitempty"`
+	Uploaded     *time.Time        `json:"uploaded,omitempty"`
+	Updated      time.Time         `json:"updated"`
+	Uploader     string            `json:"uploader,omitempty"`
+	Description  string            `json:"description,omitempty"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`
+	Version      int               `json:"version,omitempty"`
+	Versions     []FileVersion     `json:"versions,omitempty"`
+	Deleted      *time.Time        `json:"deleted,omitempty"`
+	TTL          string            `json:"ttl,omitempty"`
+	Expires      *time.Time        `json:"expires,omitempty"`
+	Revision     int64             `json:"revision"`
 }
 
+const defaultRedirectTTL = 5 * time.Minute
+
 type FileResource struct {
-	weedUrl       string
-	redisPool *redis.Pool
+	blobs       BlobStore
+	meta        MetadataStore
+	uploads     *uploadSessions
+	chunkSize   int64
+	maxVersions int
+
+	trashRetention time.Duration
+	authenticators []Authenticator
+	redirect       bool
+	redirectTTL    time.Duration
+
+	signingKey      []byte
+	maxSignedURLTTL time.Duration
 }
 
 func (f FileResource) Register(container *restful.Container) {
@@ -37,69 +71,197 @@ func (f FileResource) Register(container *restful.Container) {
 		Path("/files").
 		Consumes(restful.MIME_XML, restful.MIME_JSON).
 		Produces(restful.MIME_JSON, restful.MIME_XML)
+	if len(f.authenticators) > 0 {
+		ws.Filter(f.authenticate)
+	}
 
-	ws.Route(ws.GET("/{id}").To(f.getFileInfo).Produces("text/event-stream"))
+	ws.Route(ws.GET("").To(f.listFiles))
+	ws.Route(ws.GET("/{id}").To(f.getFileInfo).Produces("text/event-stream", restful.MIME_JSON))
 	ws.Route(ws.GET("/{id}/download").To(f.downloadFile))
 	ws.Route(ws.GET("/{id}/fetch").To(f.downloadFile))
+	ws.Route(ws.HEAD("/{id}/download").To(f.downloadFile))
+	ws.Route(ws.HEAD("/{id}/fetch").To(f.downloadFile))
 	ws.Route(ws.POST("").To(f.createFile))
 	ws.Route(ws.PUT("/{id}").To(f.uploadFile).Consumes("multipart/form-data"))
+	ws.Route(ws.PATCH("/{id}").To(f.updateFile))
+	ws.Route(ws.DELETE("/{id}").To(f.deleteFile))
+	f.registerUploads(ws)
+	f.registerVersions(ws)
+	f.registerTrash(ws)
+	f.registerSigned(ws)
+	f.registerShares(ws)
 
 	container.Add(ws)
+	f.registerPublicShares(container)
 }
 
-func (f FileResource) findFile(id string) (*File, error) {
-	conn := f.redisPool.Get()
-	defer conn.Close()
-	serialized, err := redis.Bytes(conn.Do("GET", id))
-	if err != nil {
-		return nil, nil
+func (f FileResource) downloadFile(request *restful.Request, response *restful.Response) {
+	signed := request.QueryParameter("signature") != ""
+	if signed && !f.checkSignature(request, response) {
+		return
 	}
-	var file File
-	err = json.Unmarshal(serialized, &file)
+	file, err := f.meta.Get(request.PathParameter("id"))
 	if err != nil {
-		return nil, err
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
 	}
-	return &file, nil
-}
-func (f FileResource) downloadFile(request *restful.Request, response *restful.Response) {
-	file, err := f.findFile(request.PathParameter("id"))
 	if file == nil {
 		response.AddHeader("Content-Type", "text/plain")
 		response.WriteErrorString(http.StatusNotFound, "File not found!")
 		return
 	}
-	if err != nil {
-		response.AddHeader("Content-Type", "text/plain")
-		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+	if !signed && !f.authorize(request, response, file, permRead) {
 		return
 	}
-
-	resp, err := http.Get(file.Url)
-	if err != nil {
+	if file.Deleted != nil {
 		response.AddHeader("Content-Type", "text/plain")
-		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		response.WriteErrorString(http.StatusGone, "File deleted!")
 		return
 	}
-	for k, v := range resp.Header {
-		response.Header().Set(k, v[0])
+	if expired(file) {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusGone, "File expired!")
+		return
 	}
-	response.WriteHeader(resp.StatusCode)
-	
-	if strings.HasSuffix(request.SelectedRoutePath(), "download") {
+	f.serveContent(request, response, file)
+}
+
+// serveContent sends the content file describes, which may be a past
+// version of the file. Content in a single blob is read like a file with
+// one chunk, so Range, If-Range and the conditional headers are answered by
+// http.ServeContent the same way for every blob store. In redirect mode
+// content in a single blob is left to the blob store when it can serve it.
+func (f FileResource) serveContent(request *restful.Request, response *restful.Response, file *File) {
+	if disposition, ok := request.Attribute(dispositionAttribute).(string); ok {
+		response.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%s", disposition, file.Name))
+	} else if strings.HasSuffix(request.SelectedRoutePath(), "download") {
 		response.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", file.Name))
 	}
-	io.Copy(response.ResponseWriter, resp.Body)
+	if len(file.Chunks) == 0 && f.redirects(request) && f.redirectContent(request, response, file) {
+		return
+	}
+	setDigestHeaders(response.Header(), file)
+	// The record is preferred over whatever the storage backend reports,
+	// which may be nothing at all.
+	contentType, chunks := file.ContentType, file.Chunks
+	var modTime time.Time
+	if file.Uploaded != nil {
+		modTime = *file.Uploaded
+	}
+	if len(chunks) == 0 {
+		size := file.Size
+		if file.Sha256 == "" {
+			// Stored before sizes were recorded.
+			info, err := f.blobs.Stat(file.Url)
+			if err == errBlobNotFound {
+				response.AddHeader("Content-Type", "text/plain")
+				response.WriteErrorString(http.StatusNotFound, "File content not found!")
+				return
+			}
+			if err != nil {
+				response.AddHeader("Content-Type", "text/plain")
+				response.WriteErrorString(http.StatusInternalServerError, err.Error())
+				return
+			}
+			size = info.Size
+			if contentType == "" {
+				contentType = info.ContentType
+			}
+			if modTime.IsZero() {
+				modTime = info.ModTime
+			}
+		}
+		chunks = []Chunk{{Url: file.Url, Size: size}}
+	}
+	if contentType != "" {
+		response.Header().Set("Content-Type", contentType)
+	}
+	content := newChunkReader(f.blobs, chunks)
+	defer content.Close()
+	if content.size > 0 && wantsWholeContent(request.Request) {
+		// Missing content is reported before any header is sent.
+		err := content.open()
+		if err == errBlobNotFound {
+			response.AddHeader("Content-Type", "text/plain")
+			response.WriteErrorString(http.StatusNotFound, "File content not found!")
+			return
+		}
+		if err != nil {
+			response.AddHeader("Content-Type", "text/plain")
+			response.WriteErrorString(http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	http.ServeContent(response.ResponseWriter, request.Request, file.Name, modTime, content)
+}
+
+// redirects tells whether a download is answered with a redirect. With
+// -download-mode redirect, the redirect query parameter may turn it off.
+func (f FileResource) redirects(request *restful.Request) bool {
+	redirect, err := strconv.ParseBool(request.QueryParameter("redirect"))
+	return f.redirect && (err != nil || redirect)
+}
+
+// redirectContent answers 302 to a URL of the blob store for the content of file,
+// unless the blob store has none, in which case it answers nothing. Signed
+// and shared links are only redirected to URLs that expire, or the URL
+// would outlive the checks made on the link.
+func (f FileResource) redirectContent(request *restful.Request, response *restful.Response, file *File) bool {
+	linker, ok := f.blobs.(DirectLinker)
+	if !ok {
+		return false
+	}
+	header := http.Header{}
+	if file.ContentType != "" {
+		header.Set("Content-Type", file.ContentType)
+	}
+	if disposition := response.Header().Get("Content-Disposition"); disposition != "" {
+		header.Set("Content-Disposition", disposition)
+	}
+	ttl := f.redirectTTL
+	if ttl <= 0 {
+		ttl = defaultRedirectTTL
+	}
+	location, expires, err := linker.DirectURL(file.Url, ttl, header)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	if linked, _ := request.Attribute(linkAttribute).(bool); linked && !expires {
+		return false
+	}
+	response.Header().Del("Content-Disposition")
+	response.Header().Set("Cache-Control", "no-store")
+	http.Redirect(response.ResponseWriter, request.Request, location, http.StatusFound)
+	return true
 }
+
+// wantsWholeContent tells whether r is a plain GET, which is answered with
+// the content from its start.
+func wantsWholeContent(r *http.Request) bool {
+	return r.Method == "GET" && r.Header.Get("Range") == "" &&
+		r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == ""
+}
+
 func (f FileResource) getFileInfo(request *restful.Request, response *restful.Response) {
-	file, err := f.findFile(request.PathParameter("id"))
+	file, err := f.meta.Get(request.PathParameter("id"))
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
 	if file == nil {
 		response.AddHeader("Content-Type", "text/plain")
 		response.WriteErrorString(http.StatusNotFound, "File not found!")
 		return
 	}
-	if err != nil {
-		response.AddHeader("Content-Type", "text/plain")
-		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+	if !f.authorize(request, response, file, permRead) {
+		return
+	}
+	if !acceptsEventStream(request) {
+		response.AddHeader("ETag", fileETag(file))
+		response.WriteEntity(file)
 		return
 	}
 	w := response.ResponseWriter
@@ -109,88 +271,167 @@ func (f FileResource) getFileInfo(request *restful.Request, response *restful.Re
 		response.WriteErrorString(http.StatusInternalServerError, "Streaming unsupported!")
 		return
 	}
-	ticker := time.NewTicker(time.Millisecond * 100)
 	notify := w.(http.CloseNotifier).CloseNotify()
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	fmt.Fprintf(w, "data: {\"type\": \"name\", \"content\": \"%s\"}\n\n", file.Name)
+	if file.Expires != nil {
+		fmt.Fprintf(w, "data: {\"type\": \"expires\", \"content\": \"%s\"}\n\n", file.Expires.Format(time.RFC3339))
+	}
 	flusher.Flush()
-	if file.Status == "uploading" || file.Status == "init" {
-		for _ = range ticker.C {
-    		   fileInfo, err := f.findFile(request.PathParameter("id"))
-			
-			if fileInfo == nil {
-				fmt.Fprintf(w, "data: {\"type\": \"error\", \"content\": \"not found\"}\n\n")
-				flusher.Flush()
-			}
-			if err != nil {
-				fmt.Fprintf(w, "data: {\"type\": \"error\", \"content\": \"%s\"}\n\n", err.Error())
-				flusher.Flush()
-			}
-		    if fileInfo.Status == "uploading" || file.Status == "init" {
-				fmt.Fprintf(w, "data: {\"type\": \"progress\", \"content\": \"%f\"}\n\n", fileInfo.Progress)
-				
-				flusher.Flush()
-			}
-			if fileInfo.Status == "uploaded" || fileInfo.Status == "failed" {
+	updates, stop := f.meta.Watch(file.Id)
+	defer stop()
+	// Read the record again now that the watch is in place, so that
+	// changes made since the first read are not missed.
+	fileInfo, err := f.meta.Get(file.Id)
+	if err != nil {
+		fmt.Fprintf(w, "data: {\"type\": \"error\", \"content\": \"%s\"}\n\n", err.Error())
+		flusher.Flush()
+		return
+	}
+	reported := ""
+	for {
+		if fileInfo == nil || fileInfo.Deleted != nil {
+			fmt.Fprintf(w, "data: {\"type\": \"deleted\", \"content\": \"%s\"}\n\n", file.Id)
+			flusher.Flush()
+			return
+		}
+		switch fileInfo.Status {
+		case "init":
+		case "uploading":
+			fmt.Fprintf(w, "data: {\"type\": \"progress\", \"content\": \"%f\"}\n\n", fileInfo.Progress)
+			flusher.Flush()
+		default:
+			if fileInfo.Status != reported {
 				fmt.Fprintf(w, "data: {\"type\": \"done\", \"content\": \"%s\"}\n\n", fileInfo.Status)
 				flusher.Flush()
-				ticker.Stop()
 			}
-        }
-	} else {
-		fmt.Fprintf(w, "data: {\"type\": \"done\", \"content\": \"%s\"}\n\n", file.Status)
-		flusher.Flush()
+		}
+		reported = fileInfo.Status
+		var ok bool
+		select {
+		case fileInfo, ok = <-updates:
+			if !ok {
+				<-notify
+				return
+			}
+		case <-notify:
+			return
+		}
 	}
+}
 
-	<-notify
-	ticker.Stop()
+// deleteFile moves a file to the trash, or deletes it for good if the trash
+// is disabled.
+func (f *FileResource) deleteFile(request *restful.Request, response *restful.Response) {
+	id := request.PathParameter("id")
+	if !f.uploads.begin(id) {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusConflict, "Upload in progress!")
+		return
+	}
+	defer f.uploads.end(id)
+	if f.trashRetention <= 0 {
+		f.purgeLocked(request, response)
+		return
+	}
+	identity := requestIdentity(request)
+	file, err := f.meta.Update(id, func(file *File) error {
+		if !allowed(identity, file, permDelete) {
+			return errAccessDenied
+		}
+		if file.Deleted != nil {
+			return errFileDeleted
+		}
+		now := time.Now().UTC()
+		file.Deleted = &now
+		file.Updated = now
+		return nil
+	})
+	if err == errAccessDenied {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusForbidden, "Access denied!")
+		return
+	}
+	if err == errFileDeleted {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusGone, "File deleted!")
+		return
+	}
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if file == nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "File not found!")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
 }
 
-type WeedInfo struct {
-	Fid string `json:"fid"`
-	Url string `json:"url"`
+// FileRequest holds the fields of a new file that clients choose. The rest
+// of the record, content locations and digests included, is the server's.
+type FileRequest struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	ACL         []ACLEntry        `json:"acl,omitempty"`
+	TTL         string            `json:"ttl,omitempty"`
 }
 
 func (f *FileResource) createFile(request *restful.Request, response *restful.Response) {
-	file := new(File)
-	err := request.ReadEntity(&file)
+	fileRequest := new(FileRequest)
+	err := request.ReadEntity(fileRequest)
 	if err != nil {
 		response.AddHeader("Content-Type", "text/plain")
 		response.WriteErrorString(http.StatusBadRequest, err.Error())
 		log.Println(err)
 		return
 	}
-	file.Id = uuid.New()
-	file.Status = "init"
-	resp, err := http.Post(f.weedUrl+"/dir/assign", "text/plain", nil)
+	err = validateACL(fileRequest.ACL)
 	if err != nil {
 		response.AddHeader("Content-Type", "text/plain")
 		response.WriteErrorString(http.StatusBadRequest, err.Error())
-		log.Println(err)
 		return
 	}
-	decoder := json.NewDecoder(resp.Body)
-	var info WeedInfo
-	err = decoder.Decode(&info)
-	if err != nil {
-		response.AddHeader("Content-Type", "text/plain")
-		response.WriteErrorString(http.StatusBadRequest, err.Error())
-		log.Println(err)
-		return
+	file := &File{
+		Id:          uuid.New(),
+		Name:        fileRequest.Name,
+		Status:      "init",
+		ACL:         fileRequest.ACL,
+		Created:     time.Now().UTC(),
+		Description: fileRequest.Description,
+		Attributes:  fileRequest.Attributes,
+		Tags:        normalizeTags(fileRequest.Tags),
+		TTL:         fileRequest.TTL,
+		Revision:    1,
+	}
+	file.Updated = file.Created
+	if identity := requestIdentity(request); identity != nil {
+		file.Owner = identity.User
 	}
-	file.Url = fmt.Sprintf("http://%s/%s", info.Url, info.Fid)
-	conn := f.redisPool.Get()
-	defer conn.Close()
-	serialized, err := json.Marshal(file)
+	if file.TTL != "" {
+		ttl, err := parseTTL(file.TTL)
+		if err != nil {
+			response.AddHeader("Content-Type", "text/plain")
+			response.WriteErrorString(http.StatusBadRequest, err.Error())
+			return
+		}
+		expires := file.Created.Add(ttl)
+		file.Expires = &expires
+	}
+	file.Url, err = f.assign(file, file.Id)
 	if err != nil {
 		response.AddHeader("Content-Type", "text/plain")
-		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		response.WriteErrorString(http.StatusBadRequest, err.Error())
 		log.Println(err)
 		return
 	}
-	_, err = conn.Do("SET", file.Id, serialized)
+	err = f.meta.Put(file)
 	if err != nil {
 		response.AddHeader("Content-Type", "text/plain")
 		response.WriteErrorString(http.StatusInternalServerError, err.Error())
@@ -202,146 +443,273 @@ func (f *FileResource) createFile(request *restful.Request, response *restful.Re
 }
 
 func (f *FileResource) uploadFile(request *restful.Request, response *restful.Response) {
-	fileInfo, err := f.findFile(request.PathParameter("id"))
+	fileInfo, err := f.meta.Get(request.PathParameter("id"))
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
 	if fileInfo == nil {
 		response.AddHeader("Content-Type", "text/plain")
 		response.WriteErrorString(http.StatusNotFound, "File not found!")
 		return
 	}
-	if err != nil {
+	if !f.authorize(request, response, fileInfo, permWrite) {
+		return
+	}
+	if fileInfo.Deleted != nil {
 		response.AddHeader("Content-Type", "text/plain")
-		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		response.WriteErrorString(http.StatusGone, "File deleted!")
+		return
+	}
+	if !f.uploads.begin(fileInfo.Id) {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusConflict, "Upload in progress!")
 		return
 	}
-	file, header, err := request.Request.FormFile("file")
+	defer f.uploads.end(fileInfo.Id)
+	expected, err := parseDigests(request.Request.Header)
 	if err != nil {
 		response.AddHeader("Content-Type", "text/plain")
 		response.WriteErrorString(http.StatusBadRequest, err.Error())
 		return
 	}
-	defer file.Close()
-	if fileInfo.Name != header.Filename {
+	// Count bytes as they arrive from the client and stream the file part
+	// straight to the blob store instead of letting FormFile buffer it.
+	var received int64
+	progressReader := progress.NewProgressReader(request.Request.Body, request.Request.ContentLength)
+	progressReader.OnProgress = func(float32) {
+		atomic.StoreInt64(&received, progressReader.Finished)
+	}
+	request.Request.Body = readCloser{progressReader, request.Request.Body}
+	reader, err := request.Request.MultipartReader()
+	if err != nil {
 		response.AddHeader("Content-Type", "text/plain")
-		response.WriteErrorString(http.StatusBadRequest, "File name does not match!")
+		response.WriteErrorString(http.StatusBadRequest, err.Error())
 		return
 	}
-	conn := f.redisPool.Get()
-	defer conn.Close()
-	saveFile := func() error {
-		serialized, err := json.Marshal(fileInfo)
-		if err != nil {
-			return err
+	var part *multipart.Part
+	for {
+		part, err = reader.NextPart()
+		if err == io.EOF {
+			response.AddHeader("Content-Type", "text/plain")
+			response.WriteErrorString(http.StatusBadRequest, "No file part in request!")
+			return
 		}
-		_, err = conn.Do("SET", fileInfo.Id, serialized)
 		if err != nil {
-			return err
+			response.AddHeader("Content-Type", "text/plain")
+			response.WriteErrorString(http.StatusBadRequest, err.Error())
+			return
 		}
-		return nil
+		if part.FormName() == "file" {
+			break
+		}
+	}
+	defer part.Close()
+	saveFile := func() error {
+		return f.saveUpload(fileInfo)
 	}
 	fileInfo.Status = "uploading"
 	fileInfo.Progress = 0
 	err = saveFile()
-	if err != nil{
+	if err != nil {
 		response.AddHeader("Content-Type", "text/plain")
 		response.WriteErrorString(http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	pr, pw := io.Pipe()
-	writer := multipart.NewWriter(pw)
-	progressReader := progress.NewProgressReader(file, request.Request.ContentLength)
-	ticker := time.NewTicker(time.Millisecond * 100)
-	defer ticker.Stop()
-	go func() {
-		for _ = range ticker.C {
-    		   fileInfo.Progress = progressReader.Progress()
-		   err = saveFile()
-			if err != nil{
-				response.AddHeader("Content-Type", "text/plain")
-				response.WriteErrorString(http.StatusInternalServerError, err.Error())
-				return
-			}
-        }
-	}()
-	go func() {
-		part, err := writer.CreateFormFile("file", header.Filename)
-		if err != nil {
-			pw.CloseWithError(err)
-			return
-		}
-		_, err = io.Copy(part, progressReader)
+	stop := f.trackProgress(fileInfo.Id, func() float32 {
+		return float32(atomic.LoadInt64(&received)) / float32(request.Request.ContentLength)
+	})
+	previous := *fileInfo
+	err = f.storeContent(fileInfo, fileInfo.Name, part)
+	stop()
+	status := http.StatusInternalServerError
+	if err == nil {
+		err = verifyDigests(fileInfo, expected)
 		if err != nil {
-			writer.Close()
-			pw.CloseWithError(err)
-			return
+			status = http.StatusBadRequest
+		} else {
+			err = f.shareContent(fileInfo)
 		}
-		writer.Close()
-		pw.Close()
-	}()
-	r, err := http.NewRequest("PUT", fileInfo.Url, pr)
-	if err != nil{
-		response.AddHeader("Content-Type", "text/plain")
-		response.WriteErrorString(http.StatusInternalServerError, err.Error())
-		return
 	}
-	r.Header.Set("Content-Type", writer.FormDataContentType())
-	client := &http.Client{}
-	res, err := client.Do(r)
-	if err != nil{
-		response.AddHeader("Content-Type", "text/plain")
-		response.WriteErrorString(http.StatusInternalServerError, err.Error())
-		return
-	}
-	if res.StatusCode >= 400 {
-		response.AddHeader("Content-Type", "text/plain")
-		str, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			response.AddHeader("Content-Type", "text/plain")
-			response.WriteErrorString(http.StatusInternalServerError, err.Error())
-			return
+	if err != nil {
+		f.discardContent(fileInfo)
+		currentVersion(&previous).apply(fileInfo)
+		fileInfo.Status = "failed"
+		saveErr := saveFile()
+		if saveErr != nil {
+			log.Println(saveErr)
 		}
-		response.WriteErrorString(res.StatusCode, string(str))
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(status, err.Error())
 		return
 	}
-	fileInfo.Status = "uploaded"
-	fileInfo.Progress = 100
+	markUploaded(fileInfo, request)
+	pruned := f.keepVersion(fileInfo, &previous)
 	err = saveFile()
-	if err != nil{
+	if err != nil {
 		response.AddHeader("Content-Type", "text/plain")
 		response.WriteErrorString(http.StatusInternalServerError, err.Error())
 		return
 	}
+	f.dropVersions(fileInfo, pruned)
 	response.WriteHeader(http.StatusOK)
 	response.WriteEntity(fileInfo)
 }
 
+// markUploaded records a successful upload on fileInfo.
+func markUploaded(fileInfo *File, request *restful.Request) {
+	now := time.Now().UTC()
+	fileInfo.Status = "uploaded"
+	fileInfo.Progress = 100
+	fileInfo.Uploaded = &now
+	fileInfo.Updated = now
+	fileInfo.Uploader = requestUser(request)
+}
+
+// requestUser is the user a request is made on behalf of. Without
+// authentication it is whatever the platform in front of the plugin passed
+// on.
+func requestUser(request *restful.Request) string {
+	if identity := requestIdentity(request); identity != nil {
+		return identity.User
+	}
+	return request.HeaderParameter("X-User")
+}
+
+// acceptsEventStream tells whether the client asked for the event stream of
+// a file rather than its record, which is the default for compatibility.
+func acceptsEventStream(request *restful.Request) bool {
+	accept := request.HeaderParameter("Accept")
+	return accept == "" || strings.Contains(accept, "text/event-stream") ||
+		!strings.Contains(accept, restful.MIME_JSON)
+}
+
+// trackProgress saves the progress reported by current into the record of
+// file id every 100ms until the returned function is called.
+func (f *FileResource) trackProgress(id string, current func() float32) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(time.Millisecond * 100)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				progress := current()
+				_, err := f.meta.Update(id, func(file *File) error {
+					file.Progress = progress
+					return nil
+				})
+				if err != nil {
+					log.Println(err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
 var (
+	metadata       = flag.String("metadata", "redis", "Metadata store: redis, file or memory")
+	metadataFile   = flag.String("metadata-file", "files.db", "Path of the file metadata store")
 	redisAddress   = flag.String("redis-address", ":6379", "Address to the Redis server")
 	maxConnections = flag.Int("max-connections", 10, "Max connections to Redis")
+	redisPrefix    = flag.String("redis-prefix", "file-plugin:", "Prefix of the keys in Redis")
+	migrateRedis   = flag.Bool("migrate-redis", false, "Move Redis records from bare ids to the prefixed layout and exit")
 	weedUrl        = flag.String("weed-master-url", "localhost:9393", "Weed master URL")
+	migrateWeed    = flag.Bool("migrate-weed", false, "Replace the volume server URLs recorded for SeaweedFS blobs with fids and exit")
+	storage        = flag.String("storage", "weed", "Blob storage backend: weed, local, s3 or memory")
+	localDir       = flag.String("local-dir", "data", "Directory for the local storage backend")
+	s3Endpoint     = flag.String("s3-endpoint", "https://s3.amazonaws.com", "S3 endpoint URL")
+	s3Region       = flag.String("s3-region", "us-east-1", "S3 region")
+	s3Bucket       = flag.String("s3-bucket", "", "S3 bucket")
+	s3AccessKey    = flag.String("s3-access-key", os.Getenv("AWS_ACCESS_KEY_ID"), "S3 access key")
+	s3SecretKey    = flag.String("s3-secret-key", os.Getenv("AWS_SECRET_ACCESS_KEY"), "S3 secret key")
+	s3PartSize     = flag.Int("s3-part-size", 8<<20, "Part size in bytes for S3 multipart uploads")
+	maxVersions    = flag.Int("max-versions", 10, "Versions kept per file, including the current one, 0 to keep all")
+	chunkSize      = flag.Int64("chunk-size", 0, "Split files larger than this many bytes into chunks of this size, 0 to disable")
+	trashRetention = flag.Duration("trash-retention", 30*24*time.Hour, "How long deleted files stay in the trash, 0 to delete files right away")
+	sweepInterval  = flag.Duration("sweep-interval", time.Minute, "How often expired files are deleted")
+	purgeInterval  = flag.Duration("purge-interval", time.Hour, "How often expired files are purged from the trash")
+	auth           = flag.String("auth", "", "Comma separated authenticators required on all requests: jwt, apikey; empty for none")
+	jwtHMACKey     = flag.String("jwt-hmac-key", os.Getenv("JWT_HMAC_KEY"), "Shared key of HS256 JSON Web Tokens")
+	jwtRSAKey      = flag.String("jwt-rsa-key", "", "PEM file with the public key of RS256 JSON Web Tokens")
+	apiKeys        = flag.String("api-keys", "", "File listing API keys, one \"key user [group,...]\" per line")
+	uploadDir      = flag.String("upload-dir", "uploads", "Directory staging resumable uploads")
+	urlSigningKey  = flag.String("url-signing-key", os.Getenv("URL_SIGNING_KEY"), "Key signing download links, empty to disable them")
+	maxSignedTTL   = flag.Duration("max-signed-url-ttl", 7*24*time.Hour, "Longest validity of signed download links, 0 for no limit")
+	downloadMode   = flag.String("download-mode", "proxy", "How downloads are served: proxy, or redirect to the blob store when it allows")
+	redirectTTL    = flag.Duration("redirect-ttl", defaultRedirectTTL, "Validity of the blob store URLs downloads are redirected to")
 )
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	flag.Parse()
 
-	log.Printf("Will connect redis server: %s", *redisAddress)
-	log.Printf("Max connections: %d", *maxConnections)
-	redisPool := redis.NewPool(func() (redis.Conn, error) {
-		c, err := redis.Dial("tcp", *redisAddress)
+	if *migrateRedis {
+		moved, err := newRedisStore(*redisAddress, *maxConnections, *redisPrefix).migrate()
+		log.Printf("Migrated %d records", moved)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
+	log.Printf("Metadata store: %s", *metadata)
+	meta, err := newMetadataStore(*metadata)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *migrateWeed {
+		moved, err := migrateWeedLocations(meta)
+		log.Printf("Migrated %d records", moved)
 		if err != nil {
-			log.Println(err)
-			return nil, err
+			log.Fatal(err)
 		}
+		return
+	}
+
+	log.Printf("Storage backend: %s", *storage)
+	blobs, err := newBlobStore(*storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	uploads, err := newUploadSessions(*uploadDir)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		return c, err
-	}, *maxConnections)
-	defer redisPool.Close()
+	authenticators, err := newAuthenticators(*auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *downloadMode != "proxy" && *downloadMode != "redirect" {
+		log.Fatalf("unknown download mode: %s", *downloadMode)
+	}
 
 	wsContainer := restful.NewContainer()
-	f := FileResource{*weedUrl, redisPool}
+	f := FileResource{blobs, meta, uploads, *chunkSize, *maxVersions, *trashRetention, authenticators, *downloadMode == "redirect", *redirectTTL, []byte(*urlSigningKey), *maxSignedTTL}
 	f.Register(wsContainer)
+	if *trashRetention > 0 {
+		go f.runPurger(*purgeInterval)
+	}
+	go f.runSweeper(*sweepInterval)
 	log.Printf("start listening on port " + os.Getenv("PORT"))
 	server := &http.Server{Addr: ":" + os.Getenv("PORT"), Handler: wsContainer}
 	log.Fatal(server.ListenAndServe())
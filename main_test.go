@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+)
+
+// newTestResource serves files from the memory stores. The returned
+// function removes the upload directory.
+func newTestResource(t *testing.T) (*FileResource, func()) {
+	dir, err := ioutil.TempDir("", "file-plugin-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads, err := newUploadSessions(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	f := &FileResource{blobs: newMemoryBlobStore(), meta: newMemoryStore(), uploads: uploads}
+	return f, func() { os.RemoveAll(dir) }
+}
+
+func newTestServer(f *FileResource) *httptest.Server {
+	container := restful.NewContainer()
+	f.Register(container)
+	return httptest.NewServer(container)
+}
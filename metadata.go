@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MetadataStore keeps the File records. Get returns nil and no error when
+// the record does not exist, and Delete returns the record it removed, or
+// nil if there was none, so that only one caller acts on a removal. Update
+// applies fn to the current record and writes the result atomically, unless
+// fn fails; it returns the written record, or nil if there is none. fn must
+// not call the store. List returns a page of the records matching a query.
+//
+// Watch delivers the record every time it is written and nil once it has
+// been deleted. Only the latest state is kept for slow receivers. The
+// returned function stops the watch and closes the channel.
+//
+// AddRef and Release count the references to deduplicated blobs by content
+// hash. AddRef registers location for hash unless another location is
+// already registered, and returns the registered one. Release returns the
+// location and the number of references left, removing the hash once none
+// are; it returns an empty location for unknown hashes.
+//
+// The share methods keep Share records by token the same way, and
+// ListShares returns the shares of a file, oldest first.
+type MetadataStore interface {
+	Get(id string) (*File, error)
+	Put(file *File) error
+	Delete(id string) (*File, error)
+	Update(id string, fn func(*File) error) (*File, error)
+	List(q *ListQuery) (*FileList, error)
+	Watch(id string) (<-chan *File, func())
+	AddRef(hash, location string) (string, error)
+	Release(hash string) (string, int, error)
+	GetShare(token string) (*Share, error)
+	PutShare(share *Share) error
+	UpdateShare(token string, fn func(*Share) error) (*Share, error)
+	DeleteShare(token string) error
+	ListShares(fileId string) ([]*Share, error)
+}
+
+func newMetadataStore(kind string) (MetadataStore, error) {
+	switch kind {
+	case "redis":
+		return newRedisStore(*redisAddress, *maxConnections, *redisPrefix), nil
+	case "file":
+		return newFileStore(*metadataFile)
+	case "memory":
+		return newMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown metadata store: %s", kind)
+}
+
+// watchHub fans record changes out to the watchers of in-process stores.
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[string]map[chan *File]bool
+}
+
+func (h *watchHub) watch(id string) (<-chan *File, func()) {
+	ch := make(chan *File, 1)
+	h.mu.Lock()
+	if h.watchers == nil {
+		h.watchers = make(map[string]map[chan *File]bool)
+	}
+	if h.watchers[id] == nil {
+		h.watchers[id] = make(map[chan *File]bool)
+	}
+	h.watchers[id][ch] = true
+	h.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.watchers[id], ch)
+			if len(h.watchers[id]) == 0 {
+				delete(h.watchers, id)
+			}
+			h.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (h *watchHub) notify(id string, file *File) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.watchers[id] {
+		sendLatest(ch, file)
+	}
+}
+
+// sendLatest replaces whatever is still buffered in ch with file. It must
+// only be used by the single sender of ch.
+func sendLatest(ch chan *File, file *File) {
+	select {
+	case <-ch:
+	default:
+	}
+	ch <- file
+}
+
+type blobRef struct {
+	Location string `json:"location"`
+	Count    int    `json:"count"`
+}
+
+// memoryStore keeps records in process memory. Records are stored
+// serialized so that callers never share them.
+type memoryStore struct {
+	mu      sync.RWMutex
+	records map[string][]byte
+	refs    map[string]*blobRef
+	shares  map[string][]byte
+	hub     watchHub
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{records: make(map[string][]byte), refs: make(map[string]*blobRef), shares: make(map[string][]byte)}
+}
+
+func (s *memoryStore) Get(id string) (*File, error) {
+	s.mu.RLock()
+	serialized, ok := s.records[id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	return decodeFile(serialized)
+}
+
+func (s *memoryStore) Put(file *File) error {
+	serialized, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.records[file.Id] = serialized
+	s.mu.Unlock()
+	copy, _ := decodeFile(serialized)
+	s.hub.notify(file.Id, copy)
+	return nil
+}
+
+func (s *memoryStore) Update(id string, fn func(*File) error) (*File, error) {
+	s.mu.Lock()
+	file, err := s.update(id, fn)
+	s.mu.Unlock()
+	if file != nil {
+		copy, _ := cloneFile(file)
+		s.hub.notify(id, copy)
+	}
+	return file, err
+}
+
+// update does the work of Update with s.mu held.
+func (s *memoryStore) update(id string, fn func(*File) error) (*File, error) {
+	serialized, ok := s.records[id]
+	if !ok {
+		return nil, nil
+	}
+	file, err := decodeFile(serialized)
+	if err != nil {
+		return nil, err
+	}
+	err = fn(file)
+	if err != nil {
+		return nil, err
+	}
+	serialized, err = json.Marshal(file)
+	if err != nil {
+		return nil, err
+	}
+	s.records[id] = serialized
+	return file, nil
+}
+
+func (s *memoryStore) Delete(id string) (*File, error) {
+	s.mu.Lock()
+	serialized, ok := s.records[id]
+	delete(s.records, id)
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	s.hub.notify(id, nil)
+	return decodeFile(serialized)
+}
+
+// List filters every record, which are all in memory anyway, so no
+// separate indexes are kept.
+func (s *memoryStore) List(q *ListQuery) (*FileList, error) {
+	s.mu.RLock()
+	files := make([]*File, 0, len(s.records))
+	for _, serialized := range s.records {
+		file, err := decodeFile(serialized)
+		if err != nil {
+			s.mu.RUnlock()
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	s.mu.RUnlock()
+	return pageFiles(files, q)
+}
+
+func (s *memoryStore) Watch(id string) (<-chan *File, func()) {
+	return s.hub.watch(id)
+}
+
+func (s *memoryStore) AddRef(hash, location string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref := s.refs[hash]
+	if ref == nil {
+		ref = &blobRef{Location: location}
+		s.refs[hash] = ref
+	}
+	ref.Count++
+	return ref.Location, nil
+}
+
+func (s *memoryStore) Release(hash string) (string, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref := s.refs[hash]
+	if ref == nil {
+		return "", 0, nil
+	}
+	ref.Count--
+	if ref.Count <= 0 {
+		delete(s.refs, hash)
+		return ref.Location, 0, nil
+	}
+	return ref.Location, ref.Count, nil
+}
+
+func (s *memoryStore) GetShare(token string) (*Share, error) {
+	s.mu.RLock()
+	serialized, ok := s.shares[token]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	return decodeShare(serialized)
+}
+
+func (s *memoryStore) PutShare(share *Share) error {
+	serialized, err := json.Marshal(share)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.shares[share.Token] = serialized
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) UpdateShare(token string, fn func(*Share) error) (*Share, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	serialized, ok := s.shares[token]
+	if !ok {
+		return nil, nil
+	}
+	share, err := decodeShare(serialized)
+	if err != nil {
+		return nil, err
+	}
+	err = fn(share)
+	if err != nil {
+		return nil, err
+	}
+	serialized, err = json.Marshal(share)
+	if err != nil {
+		return nil, err
+	}
+	s.shares[token] = serialized
+	return share, nil
+}
+
+func (s *memoryStore) DeleteShare(token string) error {
+	s.mu.Lock()
+	delete(s.shares, token)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) ListShares(fileId string) ([]*Share, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var shares []*Share
+	for _, serialized := range s.shares {
+		share, err := decodeShare(serialized)
+		if err != nil {
+			return nil, err
+		}
+		if share.FileId == fileId {
+			shares = append(shares, share)
+		}
+	}
+	sort.Sort(sharesByCreation(shares))
+	return shares, nil
+}
+
+func cloneFile(file *File) (*File, error) {
+	serialized, err := json.Marshal(file)
+	if err != nil {
+		return nil, err
+	}
+	return decodeFile(serialized)
+}
+
+func decodeFile(serialized []byte) (*File, error) {
+	var file File
+	err := json.Unmarshal(serialized, &file)
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"github.com/emicklei/go-restful"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	errFileNotFound     = errors.New("file not found")
+	errFileDeleted      = errors.New("file deleted")
+	errRevisionMismatch = errors.New("revision mismatch")
+)
+
+// filePatch lists the fields PATCH /files/{id} may change. Fields left out
+// are kept; an attribute set to null is removed. Tags and the ACL replace
+// the current ones. Only the owner may change the owner and the ACL.
+type filePatch struct {
+	Name        *string            `json:"name"`
+	Description *string            `json:"description"`
+	Attributes  map[string]*string `json:"attributes"`
+	Tags        *[]string          `json:"tags"`
+	Owner       *string            `json:"owner"`
+	ACL         *[]ACLEntry        `json:"acl"`
+}
+
+func (p *filePatch) apply(file *File) {
+	if p.Name != nil {
+		file.Name = *p.Name
+	}
+	if p.Description != nil {
+		file.Description = *p.Description
+	}
+	if p.Tags != nil {
+		file.Tags = normalizeTags(*p.Tags)
+	}
+	if p.Owner != nil {
+		file.Owner = *p.Owner
+	}
+	if p.ACL != nil {
+		file.ACL = *p.ACL
+	}
+	for key, value := range p.Attributes {
+		if value == nil {
+			delete(file.Attributes, key)
+			continue
+		}
+		if file.Attributes == nil {
+			file.Attributes = make(map[string]string)
+		}
+		file.Attributes[key] = *value
+	}
+}
+
+// fileETag is the entity tag of a file record. It changes whenever the
+// fields that PATCH edits do, not with the progress of uploads.
+func fileETag(file *File) string {
+	return `"` + strconv.FormatInt(file.Revision, 10) + `"`
+}
+
+// updateFile edits the metadata of a file. With an If-Match header the edit
+// only goes through if nobody else changed the file since the client read it.
+func (f *FileResource) updateFile(request *restful.Request, response *restful.Response) {
+	patch := new(filePatch)
+	err := request.ReadEntity(patch)
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+	if patch.Name != nil && *patch.Name == "" {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusBadRequest, "Name must not be empty!")
+		return
+	}
+	if patch.Owner != nil && *patch.Owner == "" {
+		// A file without an owner may be changed by anyone.
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusBadRequest, "Owner must not be empty!")
+		return
+	}
+	if patch.ACL != nil {
+		err = validateACL(*patch.ACL)
+		if err != nil {
+			response.AddHeader("Content-Type", "text/plain")
+			response.WriteErrorString(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	identity := requestIdentity(request)
+	ifMatch := request.HeaderParameter("If-Match")
+	file, err := f.meta.Update(request.PathParameter("id"), func(file *File) error {
+		if !allowed(identity, file, permWrite) ||
+			(patch.Owner != nil || patch.ACL != nil) && !isOwner(identity, file) {
+			return errAccessDenied
+		}
+		if file.Deleted != nil {
+			return errFileDeleted
+		}
+		if ifMatch != "" && ifMatch != "*" && ifMatch != fileETag(file) {
+			return errRevisionMismatch
+		}
+		patch.apply(file)
+		file.Revision++
+		file.Updated = time.Now().UTC()
+		return nil
+	})
+	if err == errAccessDenied {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusForbidden, "Access denied!")
+		return
+	}
+	if err == errFileDeleted {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusGone, "File deleted!")
+		return
+	}
+	if err == errRevisionMismatch {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusPreconditionFailed, "File was changed by someone else!")
+		return
+	}
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if file == nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "File not found!")
+		return
+	}
+	response.AddHeader("ETag", fileETag(file))
+	response.WriteEntity(file)
+}
+
+// saveUpload writes the upload state kept in fileInfo to the record, leaving
+// the fields edited through PATCH as they are in the store, and refreshes
+// fileInfo with those.
+func (f *FileResource) saveUpload(fileInfo *File) error {
+	file, err := f.meta.Update(fileInfo.Id, func(file *File) error {
+		file.Status = fileInfo.Status
+		file.Progress = fileInfo.Progress
+		file.Url = fileInfo.Url
+		file.Size = fileInfo.Size
+		file.Offset = fileInfo.Offset
+		file.UploadLength = fileInfo.UploadLength
+		file.Chunks = fileInfo.Chunks
+		file.Sha256 = fileInfo.Sha256
+		file.Md5 = fileInfo.Md5
+		file.ContentType = fileInfo.ContentType
+		file.Uploaded = fileInfo.Uploaded
+		file.Uploader = fileInfo.Uploader
+		file.Version = fileInfo.Version
+		file.Versions = fileInfo.Versions
+		if fileInfo.Updated.After(file.Updated) {
+			file.Updated = fileInfo.Updated
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if file == nil {
+		return errFileNotFound
+	}
+	*fileInfo = *file
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPatchOwner(t *testing.T) {
+	f, cleanup := newTestResource(t)
+	defer cleanup()
+	keys, err := ioutil.TempFile("", "api-keys-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keys.Name())
+	keys.WriteString("alice-key alice\nbob-key bob\n")
+	keys.Close()
+	authenticator, err := newAPIKeyAuthenticator(keys.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.authenticators = []Authenticator{authenticator}
+	srv := newTestServer(f)
+	defer srv.Close()
+	f.meta.Put(&File{Id: "f1", Name: "a.txt", Owner: "alice", Status: "init", Revision: 1})
+
+	patch := func(key, body string) int {
+		req, _ := http.NewRequest("PATCH", srv.URL+"/files/f1", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", key)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if status := patch("alice-key", `{"owner":""}`); status != http.StatusBadRequest {
+		t.Fatalf("clearing the owner: %d", status)
+	}
+	if status := patch("bob-key", `{"name":"b.txt"}`); status != http.StatusForbidden {
+		t.Fatalf("edit by another user: %d", status)
+	}
+	if status := patch("alice-key", `{"owner":"bob"}`); status != http.StatusOK {
+		t.Fatalf("handing the file over: %d", status)
+	}
+	if file, _ := f.meta.Get("f1"); file.Owner != "bob" {
+		t.Fatalf("owner %q", file.Owner)
+	}
+}
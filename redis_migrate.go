@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"strings"
+)
+
+// migrate moves everything still kept in the original layout to the current
+// one: the records under bare ids, the blob references and the indexes. It
+// can run while the plugin is serving, since the store reads both layouts
+// and records written in the current layout meanwhile take precedence.
+func (s *redisStore) migrate() (int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	moved := 0
+	legacyIndexes := map[string]bool{"files:by-created": true, "files:by-name": true}
+	err := redisScan(conn, "*", func(key string) error {
+		if !isLegacyId(key) {
+			return nil
+		}
+		file, err := s.migrateRecord(conn, key)
+		if err != nil || file == nil {
+			return err
+		}
+		moved++
+		legacyIndexes["files:status:"+file.Status] = true
+		if file.Owner != "" {
+			legacyIndexes["files:owner:"+file.Owner] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return moved, err
+	}
+
+	err = redisScan(conn, "blob:*", func(key string) error {
+		hash := strings.TrimPrefix(key, "blob:")
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha256.Size {
+			return nil
+		}
+		_, err := migrateRefScript.Do(conn, s.blobKey(hash), key)
+		return err
+	})
+	if err != nil {
+		return moved, err
+	}
+
+	for key := range legacyIndexes {
+		_, err = conn.Do("DEL", key)
+		if err != nil {
+			return moved, err
+		}
+	}
+	_, err = conn.Do("SET", s.prefix+"schema", redisSchemaVersion)
+	return moved, err
+}
+
+// migrated tells whether migrate has completed, so that every record is in
+// the current layout.
+func (s *redisStore) migrated() (bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	version, err := redis.Int(conn.Do("GET", s.prefix+"schema"))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return version >= redisSchemaVersion, err
+}
+
+// migrateRecord moves the record under the bare id to the current layout
+// and indexes it. It returns nil if the key turns out not to hold a record.
+func (s *redisStore) migrateRecord(conn redis.Conn, id string) (*File, error) {
+	for {
+		_, err := conn.Do("WATCH", id, s.fileKey(id))
+		if err != nil {
+			return nil, err
+		}
+		serialized, err := redis.Bytes(conn.Do("GET", id))
+		if err != nil {
+			conn.Do("UNWATCH")
+			if err == redis.ErrNil {
+				return nil, nil
+			}
+			if _, ok := err.(redis.Error); ok {
+				// Not a string, so not ours.
+				return nil, nil
+			}
+			return nil, err
+		}
+		file, err := decodeFile(serialized)
+		if err != nil || file.Id != id {
+			conn.Do("UNWATCH")
+			log.Printf("skipping %s: not a file record", id)
+			return nil, nil
+		}
+		exists, err := redis.Bool(conn.Do("EXISTS", s.fileKey(id)))
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+		record, err := json.Marshal(redisRecord{redisSchemaVersion, file})
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+		conn.Send("MULTI")
+		if !exists {
+			conn.Send("SET", s.fileKey(id), record)
+			s.index(conn, file)
+		}
+		conn.Send("DEL", id)
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+		if reply != nil {
+			return file, nil
+		}
+	}
+}
+
+// redisScan calls fn for every key matching pattern.
+func redisScan(conn redis.Conn, pattern string, fn func(key string) error) error {
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		_, err = redis.Scan(reply, &cursor, &keys)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			err = fn(key)
+			if err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,723 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisSchemaVersion is the version of the record layout written by
+// redisStore. Records are stored as a redisRecord under prefix+"file:"+id,
+// with the indexes and blob references under the same prefix. Version 0 is
+// the original layout, the bare File JSON under the bare id, which is still
+// read until it has been migrated.
+const redisSchemaVersion = 1
+
+// redisExpiryGrace is how long after a file expires Redis drops its record.
+const redisExpiryGrace = 24 * time.Hour
+
+type redisRecord struct {
+	Version int   `json:"version"`
+	File    *File `json:"file"`
+}
+
+// redisStore keeps each record along with sorted set indexes by creation
+// time and name and sets of ids by status, owner, tag and attribute. Writes are also
+// published on a per-file channel so that watchers on any instance of the
+// plugin see them.
+type redisStore struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+func newRedisStore(address string, maxConnections int, prefix string) *redisStore {
+	log.Printf("Will connect redis server: %s", address)
+	log.Printf("Max connections: %d", maxConnections)
+	pool := redis.NewPool(func() (redis.Conn, error) {
+		c, err := redis.Dial("tcp", address)
+
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+
+		return c, err
+	}, maxConnections)
+	return &redisStore{pool, prefix}
+}
+
+func (s *redisStore) Get(id string) (*File, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	return s.get(conn, id)
+}
+
+// keys are the keys the record of id may be under: its key in the current
+// layout and, for a file id, the bare id of the original layout. Other ids
+// never reach keys outside the prefix, which belong to someone else.
+func (s *redisStore) keys(id string) []interface{} {
+	if isLegacyId(id) {
+		return []interface{}{s.fileKey(id), id}
+	}
+	return []interface{}{s.fileKey(id)}
+}
+
+func isLegacyId(key string) bool {
+	return len(key) == 36 && uuid.Parse(key) != nil
+}
+
+// get reads the record of id in the current layout, falling back to the
+// original one.
+func (s *redisStore) get(conn redis.Conn, id string) (*File, error) {
+	values, err := redis.Values(conn.Do("MGET", s.keys(id)...))
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		if serialized, ok := value.([]byte); ok {
+			return decodeRedisRecord(serialized)
+		}
+	}
+	return nil, nil
+}
+
+func decodeRedisRecord(serialized []byte) (*File, error) {
+	var record redisRecord
+	err := json.Unmarshal(serialized, &record)
+	if err != nil {
+		return nil, err
+	}
+	if record.Version == 0 {
+		return decodeFile(serialized)
+	}
+	if record.Version > redisSchemaVersion || record.File == nil {
+		return nil, fmt.Errorf("unsupported record version %d", record.Version)
+	}
+	return record.File, nil
+}
+
+func (s *redisStore) Put(file *File) error {
+	_, err := s.write(file.Id, func(*File) (*File, error) {
+		return file, nil
+	})
+	return err
+}
+
+func (s *redisStore) Update(id string, fn func(*File) error) (*File, error) {
+	return s.write(id, func(old *File) (*File, error) {
+		if old == nil {
+			return nil, nil
+		}
+		file, err := cloneFile(old)
+		if err != nil {
+			return nil, err
+		}
+		return file, fn(file)
+	})
+}
+
+// write replaces the record of id with what update makes of the current
+// one, along with its index entries, in one transaction that is retried if
+// the record changes in the meantime. Nothing is written if update returns
+// nil. A record still in the original layout is moved to the current one.
+func (s *redisStore) write(id string, update func(old *File) (*File, error)) (*File, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	for {
+		_, err := conn.Do("WATCH", s.keys(id)...)
+		if err != nil {
+			return nil, err
+		}
+		old, err := s.get(conn, id)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+		file, err := update(old)
+		if err != nil || file == nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+		serialized, err := json.Marshal(file)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+		record, err := json.Marshal(redisRecord{redisSchemaVersion, file})
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+		conn.Send("MULTI")
+		conn.Send("SET", s.fileKey(id), record)
+		if file.Expires != nil {
+			// Records of expired files are removed by the sweeper along
+			// with their content; this is for when no sweeper runs.
+			conn.Send("PEXPIREAT", s.fileKey(id), redisTime(file.Expires.Add(redisExpiryGrace)))
+		}
+		if old != nil {
+			if isLegacyId(id) {
+				conn.Send("DEL", id)
+			}
+			s.unindex(conn, old)
+		}
+		s.index(conn, file)
+		conn.Send("PUBLISH", s.channel(id), serialized)
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+		if reply != nil {
+			return file, nil
+		}
+	}
+}
+
+// Delete removes the record in a transaction that fails if the record
+// changes in the meantime, so of several instances deleting the same
+// record only one gets it back.
+func (s *redisStore) Delete(id string) (*File, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	for {
+		_, err := conn.Do("WATCH", s.keys(id)...)
+		if err != nil {
+			return nil, err
+		}
+		old, err := s.get(conn, id)
+		if err != nil || old == nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+		conn.Send("MULTI")
+		conn.Send("DEL", s.keys(id)...)
+		s.unindex(conn, old)
+		conn.Send("PUBLISH", s.channel(id), "")
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+		if reply != nil {
+			return old, nil
+		}
+	}
+}
+
+// redisSetScanLimit is the size up to which the intersection of the status,
+// owner, tag and attribute sets is listed whole rather than filtered out of
+// a walk of the sort index.
+const redisSetScanLimit = 4 * maxListLimit
+
+// redisListSlack is how many records beyond a page are read at a time from
+// the sort index, for the ones that turn out not to match.
+const redisListSlack = 16
+
+// List walks the index of the sort order from the cursor, reading records a
+// page at a time until a page of them match. Narrower candidate sets are
+// listed whole instead: the intersection of the status, owner, tag and
+// attribute sets when it is small, the expiry index for expired files, the
+// trash index for files in the trash and the name index for a name prefix
+// when sorting by creation time. Records in the original layout are not
+// indexed, so they are only listed once migrated.
+func (s *redisStore) List(q *ListQuery) (*FileList, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	var keys []interface{}
+	if q.Status != "" {
+		keys = append(keys, s.statusKey(q.Status))
+	}
+	if q.Owner != "" {
+		keys = append(keys, s.ownerKey(q.Owner))
+	}
+	for _, tag := range q.Tags {
+		keys = append(keys, s.tagKey(tag))
+	}
+	for key, value := range q.Attributes {
+		keys = append(keys, s.attributeKey(key, value))
+	}
+	var ids []string
+	var err error
+	switch {
+	case len(keys) > 0 && s.smallestSet(conn, keys) <= redisSetScanLimit:
+		ids, err = redis.Strings(conn.Do("SINTER", keys...))
+	case !q.ExpiredBefore.IsZero():
+		max := "(" + strconv.FormatInt(redisTime(q.ExpiredBefore), 10)
+		ids, err = redis.Strings(conn.Do("ZRANGEBYSCORE", s.expiresKey(), "-inf", max))
+	case q.Trashed:
+		max := "+inf"
+		if !q.DeletedBefore.IsZero() {
+			max = "(" + strconv.FormatInt(redisTime(q.DeletedBefore), 10)
+		}
+		ids, err = redis.Strings(conn.Do("ZRANGEBYSCORE", s.trashKey(), "-inf", max))
+	case q.Prefix != "" && !q.byName():
+		var members []string
+		members, err = redis.Strings(conn.Do("ZRANGEBYLEX", s.nameKey(), "["+q.Prefix, "["+q.Prefix+"\xff"))
+		for _, member := range members {
+			ids = append(ids, nameIndexId(member))
+		}
+	default:
+		return s.walk(conn, q)
+	}
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.getMany(conn, ids)
+	if err != nil {
+		return nil, err
+	}
+	return pageFiles(files, q)
+}
+
+// smallestSet returns the size of the smallest of the sets at keys.
+func (s *redisStore) smallestSet(conn redis.Conn, keys []interface{}) int {
+	smallest := -1
+	for _, key := range keys {
+		n, err := redis.Int(conn.Do("SCARD", key))
+		if err == nil && (smallest < 0 || n < smallest) {
+			smallest = n
+		}
+	}
+	return smallest
+}
+
+// walk reads the sort index from the cursor on, in batches of a page and
+// some slack, until more than a page of records match or the index ends.
+func (s *redisStore) walk(conn redis.Conn, q *ListQuery) (*FileList, error) {
+	after, err := q.after()
+	if err != nil {
+		return nil, err
+	}
+	limit := q.limit()
+	batch := limit + 1 + redisListSlack
+	var files []*File
+	for offset := 0; len(files) <= limit; offset += batch {
+		members, err := s.rangeIndex(conn, q, after, offset, batch)
+		if err != nil {
+			return nil, err
+		}
+		ids := members
+		if q.byName() {
+			ids = make([]string, len(members))
+			for i, member := range members {
+				ids[i] = nameIndexId(member)
+			}
+		}
+		records, err := s.getMany(conn, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range records {
+			if q.matches(file) && (after == nil || q.less(*after, q.key(file))) {
+				files = append(files, file)
+			}
+		}
+		if len(members) < batch {
+			break
+		}
+	}
+	return pageFiles(files, q)
+}
+
+// rangeIndex returns count members of the sort index of q, skipping offset
+// of them, from the cursor on. The creation time index only has
+// millisecond scores, so it is read from the millisecond of the cursor and
+// the records up to the cursor are dropped by the caller.
+func (s *redisStore) rangeIndex(conn redis.Conn, q *ListQuery, after *listCursor, offset, count int) ([]string, error) {
+	desc := strings.HasPrefix(q.Sort, "-")
+	if q.byName() {
+		min, max := "["+q.Prefix, "["+q.Prefix+"\xff"
+		if after != nil {
+			if desc {
+				max = "(" + after.Name + "\x00" + after.Id
+			} else {
+				min = "(" + after.Name + "\x00" + after.Id
+			}
+		}
+		if desc {
+			return redis.Strings(conn.Do("ZREVRANGEBYLEX", s.nameKey(), max, min, "LIMIT", offset, count))
+		}
+		return redis.Strings(conn.Do("ZRANGEBYLEX", s.nameKey(), min, max, "LIMIT", offset, count))
+	}
+	min, max := "-inf", "+inf"
+	if after != nil {
+		score := strconv.FormatInt(after.Created/int64(time.Millisecond), 10)
+		if desc {
+			max = score
+		} else {
+			min = score
+		}
+	}
+	if desc {
+		return redis.Strings(conn.Do("ZREVRANGEBYSCORE", s.createdKey(), max, min, "LIMIT", offset, count))
+	}
+	return redis.Strings(conn.Do("ZRANGEBYSCORE", s.createdKey(), min, max, "LIMIT", offset, count))
+}
+
+// nameIndexId is the id in a member of the name index.
+func nameIndexId(member string) string {
+	return member[strings.LastIndex(member, "\x00")+1:]
+}
+
+func (s *redisStore) getMany(conn redis.Conn, ids []string) ([]*File, error) {
+	var files []*File
+	for start := 0; start < len(ids); start += 500 {
+		end := start + 500
+		if end > len(ids) {
+			end = len(ids)
+		}
+		args := make([]interface{}, 0, end-start)
+		for _, id := range ids[start:end] {
+			args = append(args, s.fileKey(id))
+		}
+		values, err := redis.Values(conn.Do("MGET", args...))
+		if err != nil {
+			return nil, err
+		}
+		for i, value := range values {
+			serialized, ok := value.([]byte)
+			if !ok {
+				continue
+			}
+			file, err := decodeRedisRecord(serialized)
+			if err != nil {
+				log.Printf("skipping %s: %v", ids[start+i], err)
+				continue
+			}
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// redisTime is the score of t in the time indexes.
+func redisTime(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (s *redisStore) index(conn redis.Conn, file *File) {
+	conn.Send("ZADD", s.createdKey(), redisTime(file.Created), file.Id)
+	if file.Deleted != nil {
+		conn.Send("ZADD", s.trashKey(), redisTime(*file.Deleted), file.Id)
+	}
+	if file.Expires != nil {
+		conn.Send("ZADD", s.expiresKey(), redisTime(*file.Expires), file.Id)
+	}
+	conn.Send("ZADD", s.nameKey(), 0, file.Name+"\x00"+file.Id)
+	conn.Send("SADD", s.statusKey(file.Status), file.Id)
+	if file.Owner != "" {
+		conn.Send("SADD", s.ownerKey(file.Owner), file.Id)
+	}
+	for _, tag := range file.Tags {
+		conn.Send("SADD", s.tagKey(tag), file.Id)
+	}
+	for key, value := range file.Attributes {
+		conn.Send("SADD", s.attributeKey(key, value), file.Id)
+	}
+}
+
+func (s *redisStore) unindex(conn redis.Conn, file *File) {
+	conn.Send("ZREM", s.createdKey(), file.Id)
+	conn.Send("ZREM", s.trashKey(), file.Id)
+	conn.Send("ZREM", s.expiresKey(), file.Id)
+	conn.Send("ZREM", s.nameKey(), file.Name+"\x00"+file.Id)
+	conn.Send("SREM", s.statusKey(file.Status), file.Id)
+	if file.Owner != "" {
+		conn.Send("SREM", s.ownerKey(file.Owner), file.Id)
+	}
+	for _, tag := range file.Tags {
+		conn.Send("SREM", s.tagKey(tag), file.Id)
+	}
+	for key, value := range file.Attributes {
+		conn.Send("SREM", s.attributeKey(key, value), file.Id)
+	}
+}
+
+// Watch subscribes a pooled connection to the file's channel. The receiving
+// goroutine owns the connection: stopping only unsubscribes, and the
+// goroutine closes the connection once the server confirms it or the
+// connection fails.
+func (s *redisStore) Watch(id string) (<-chan *File, func()) {
+	ch := make(chan *File, 1)
+	done := make(chan struct{})
+	conn := redis.PubSubConn{Conn: s.pool.Get()}
+	var mu sync.Mutex
+	closed := false
+	err := conn.Subscribe(s.channel(id))
+	if err != nil {
+		log.Println(err)
+	}
+	go func() {
+		defer close(ch)
+		defer func() {
+			mu.Lock()
+			closed = true
+			conn.Close()
+			mu.Unlock()
+		}()
+		for {
+			switch msg := conn.Receive().(type) {
+			case redis.Message:
+				var file *File
+				if len(msg.Data) > 0 {
+					var err error
+					file, err = decodeFile(msg.Data)
+					if err != nil {
+						log.Println(err)
+						continue
+					}
+				}
+				select {
+				case <-done:
+				default:
+					sendLatest(ch, file)
+				}
+			case redis.Subscription:
+				if msg.Count == 0 {
+					return
+				}
+			case error:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			close(done)
+			mu.Lock()
+			defer mu.Unlock()
+			if !closed {
+				conn.Unsubscribe()
+			}
+		})
+	}
+}
+
+// adoptLegacyRef moves the reference count of a hash from its key in the
+// original layout, KEYS[2], to the current one, KEYS[1].
+const adoptLegacyRef = `
+if KEYS[1] ~= KEYS[2] and redis.call("EXISTS", KEYS[2]) == 1 then
+	if redis.call("EXISTS", KEYS[1]) == 0 then
+		redis.call("RENAME", KEYS[2], KEYS[1])
+	else
+		redis.call("HINCRBY", KEYS[1], "count", redis.call("HGET", KEYS[2], "count") or 0)
+		redis.call("DEL", KEYS[2])
+	end
+end
+`
+
+var addRefScript = redis.NewScript(2, adoptLegacyRef+`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	redis.call("HSET", KEYS[1], "location", ARGV[1])
+end
+redis.call("HINCRBY", KEYS[1], "count", 1)
+return redis.call("HGET", KEYS[1], "location")
+`)
+
+var releaseScript = redis.NewScript(2, adoptLegacyRef+`
+local location = redis.call("HGET", KEYS[1], "location")
+if not location then
+	return {"", 0}
+end
+local count = redis.call("HINCRBY", KEYS[1], "count", -1)
+if count <= 0 then
+	redis.call("DEL", KEYS[1])
+	count = 0
+end
+return {location, count}
+`)
+
+var migrateRefScript = redis.NewScript(2, adoptLegacyRef)
+
+func (s *redisStore) AddRef(hash, location string) (string, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	return redis.String(addRefScript.Do(conn, s.blobKey(hash), "blob:"+hash, location))
+}
+
+func (s *redisStore) Release(hash string) (string, int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	reply, err := redis.Values(releaseScript.Do(conn, s.blobKey(hash), "blob:"+hash))
+	if err != nil {
+		return "", 0, err
+	}
+	var location string
+	var count int
+	_, err = redis.Scan(reply, &location, &count)
+	return location, count, err
+}
+
+func (s *redisStore) GetShare(token string) (*Share, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	return s.getShare(conn, token)
+}
+
+func (s *redisStore) getShare(conn redis.Conn, token string) (*Share, error) {
+	serialized, err := redis.Bytes(conn.Do("GET", s.shareKey(token)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeShare(serialized)
+}
+
+func (s *redisStore) PutShare(share *Share) error {
+	serialized, err := json.Marshal(share)
+	if err != nil {
+		return err
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("SET", s.shareKey(share.Token), serialized)
+	conn.Send("SADD", s.sharesKey(share.FileId), share.Token)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// UpdateShare retries like write when the share changes in the meantime,
+// so that concurrent downloads are all counted.
+func (s *redisStore) UpdateShare(token string, fn func(*Share) error) (*Share, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	for {
+		_, err := conn.Do("WATCH", s.shareKey(token))
+		if err != nil {
+			return nil, err
+		}
+		share, err := s.getShare(conn, token)
+		if err == nil && share != nil {
+			err = fn(share)
+		}
+		if err != nil || share == nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+		serialized, err := json.Marshal(share)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+		conn.Send("MULTI")
+		conn.Send("SET", s.shareKey(token), serialized)
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+		if reply != nil {
+			return share, nil
+		}
+	}
+}
+
+func (s *redisStore) DeleteShare(token string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	share, err := s.getShare(conn, token)
+	if err != nil || share == nil {
+		return err
+	}
+	conn.Send("MULTI")
+	conn.Send("DEL", s.shareKey(token))
+	conn.Send("SREM", s.sharesKey(share.FileId), token)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (s *redisStore) ListShares(fileId string) ([]*Share, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	tokens, err := redis.Strings(conn.Do("SMEMBERS", s.sharesKey(fileId)))
+	if err != nil || len(tokens) == 0 {
+		return nil, err
+	}
+	args := make([]interface{}, 0, len(tokens))
+	for _, token := range tokens {
+		args = append(args, s.shareKey(token))
+	}
+	values, err := redis.Values(conn.Do("MGET", args...))
+	if err != nil {
+		return nil, err
+	}
+	var shares []*Share
+	for i, value := range values {
+		serialized, ok := value.([]byte)
+		if !ok {
+			continue
+		}
+		share, err := decodeShare(serialized)
+		if err != nil {
+			log.Printf("skipping share %s: %v", tokens[i], err)
+			continue
+		}
+		shares = append(shares, share)
+	}
+	sort.Sort(sharesByCreation(shares))
+	return shares, nil
+}
+
+func (s *redisStore) fileKey(id string) string {
+	return s.prefix + "file:" + id
+}
+
+func (s *redisStore) createdKey() string {
+	return s.prefix + "index:created"
+}
+
+func (s *redisStore) trashKey() string {
+	return s.prefix + "index:trash"
+}
+
+func (s *redisStore) expiresKey() string {
+	return s.prefix + "index:expires"
+}
+
+func (s *redisStore) nameKey() string {
+	return s.prefix + "index:name"
+}
+
+func (s *redisStore) statusKey(status string) string {
+	return s.prefix + "index:status:" + status
+}
+
+func (s *redisStore) ownerKey(owner string) string {
+	return s.prefix + "index:owner:" + owner
+}
+
+func (s *redisStore) tagKey(tag string) string {
+	return s.prefix + "index:tag:" + tag
+}
+
+// attributeKey is the index of files with attribute key set to value. The
+// length of the key keeps "a=b" and "c" apart from "a" and "b=c".
+func (s *redisStore) attributeKey(key, value string) string {
+	return s.prefix + "index:attr:" + strconv.Itoa(len(key)) + ":" + key + "=" + value
+}
+
+func (s *redisStore) shareKey(token string) string {
+	return s.prefix + "share:" + token
+}
+
+// sharesKey is the set of tokens of the shares of a file.
+func (s *redisStore) sharesKey(fileId string) string {
+	return s.prefix + "index:shares:" + fileId
+}
+
+func (s *redisStore) blobKey(hash string) string {
+	return s.prefix + "blob:" + hash
+}
+
+func (s *redisStore) channel(id string) string {
+	return s.prefix + "file:" + id
+}
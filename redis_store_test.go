@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// fakePubSub is a Redis server that knows just enough of the protocol for
+// subscriptions: SUBSCRIBE, UNSUBSCRIBE, PUNSUBSCRIBE and ECHO.
+type fakePubSub struct {
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn]map[string]bool
+}
+
+func newFakePubSub(t *testing.T) *fakePubSub {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakePubSub{listener: listener, conns: make(map[net.Conn]map[string]bool)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakePubSub) Close() {
+	f.listener.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func (f *fakePubSub) serve(conn net.Conn) {
+	f.mu.Lock()
+	f.conns[conn] = make(map[string]bool)
+	f.mu.Unlock()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		f.mu.Lock()
+		channels := f.conns[conn]
+		switch strings.ToUpper(args[0]) {
+		case "SUBSCRIBE":
+			for _, channel := range args[1:] {
+				channels[channel] = true
+				writeReply(conn, "subscribe", channel, len(channels))
+			}
+		case "UNSUBSCRIBE":
+			if len(channels) == 0 {
+				writeReply(conn, "unsubscribe", nil, 0)
+			}
+			for channel := range channels {
+				delete(channels, channel)
+				writeReply(conn, "unsubscribe", channel, len(channels))
+			}
+		case "PUNSUBSCRIBE":
+			writeReply(conn, "punsubscribe", nil, 0)
+		case "ECHO":
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(args[1]), args[1])
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command\r\n")
+		}
+		f.mu.Unlock()
+	}
+}
+
+func (f *fakePubSub) publish(channel, message string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn, channels := range f.conns {
+		if channels[channel] {
+			writeReply(conn, "message", channel, message)
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func writeReply(w io.Writer, kind string, channel interface{}, value interface{}) {
+	fmt.Fprintf(w, "*3\r\n$%d\r\n%s\r\n", len(kind), kind)
+	if channel == nil {
+		fmt.Fprint(w, "$-1\r\n")
+	} else {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(channel.(string)), channel)
+	}
+	switch value := value.(type) {
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", value)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(value), value)
+	}
+}
+
+func TestRedisWatchStop(t *testing.T) {
+	server := newFakePubSub(t)
+	defer server.Close()
+	store := newRedisStore(server.listener.Addr().String(), 2, "test:")
+
+	for i := 0; i < 3; i++ {
+		ch, stop := store.Watch("f1")
+		// Wait for the subscription before publishing.
+		deadline := time.Now().Add(time.Second)
+		for {
+			server.mu.Lock()
+			subscribed := 0
+			for _, channels := range server.conns {
+				if channels[store.channel("f1")] {
+					subscribed++
+				}
+			}
+			server.mu.Unlock()
+			if subscribed > 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("not subscribed")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		server.publish(store.channel("f1"), `{"id":"f1","name":"a"}`)
+		select {
+		case file := <-ch:
+			if file == nil || file.Name != "a" {
+				t.Fatalf("got %+v", file)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no change received")
+		}
+
+		stopped := make(chan struct{})
+		go func() {
+			stop()
+			stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("stop hung")
+		}
+		select {
+		case _, ok := <-ch:
+			for ok {
+				_, ok = <-ch
+			}
+		case <-time.After(time.Second):
+			t.Fatal("watch not closed")
+		}
+	}
+	// Every connection went back to the pool.
+	if active := store.pool.ActiveCount(); active > 1 {
+		t.Fatalf("%d connections active", active)
+	}
+}
+
+// mapConn answers MGET from a map, which is all get needs.
+type mapConn struct {
+	redis.Conn
+	values map[string]string
+}
+
+func (c mapConn) Do(command string, args ...interface{}) (interface{}, error) {
+	if command != "MGET" {
+		return nil, fmt.Errorf("unexpected %s", command)
+	}
+	var reply []interface{}
+	for _, key := range args {
+		if value, ok := c.values[key.(string)]; ok {
+			reply = append(reply, []byte(value))
+		} else {
+			reply = append(reply, nil)
+		}
+	}
+	return reply, nil
+}
+
+func TestRedisLegacyKeys(t *testing.T) {
+	store := &redisStore{prefix: "test:"}
+	id := "0c6b7a9e-7d2c-4f43-9c36-5b8e0d3f6a21"
+	conn := mapConn{values: map[string]string{
+		id:               `{"id":"` + id + `","name":"legacy"}`,
+		"config":         `{"id":"config","name":"someone else's"}`,
+		"urn:uuid:" + id: `{"id":"x"}`,
+	}}
+	file, err := store.get(conn, id)
+	if err != nil || file == nil || file.Name != "legacy" {
+		t.Fatalf("legacy record: %+v %v", file, err)
+	}
+	for _, other := range []string{"config", "urn:uuid:" + id} {
+		file, err = store.get(conn, other)
+		if err != nil || file != nil {
+			t.Fatalf("%s: %+v %v", other, file, err)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3MinPartSize      = 5 << 20
+	s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3Store keeps blobs in a bucket of an S3 compatible object store such as
+// AWS S3 or MinIO. Requests are path-style and signed with AWS Signature
+// Version 4. Locations have the form s3://bucket/key.
+type s3Store struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	partSize  int
+	client    *http.Client
+}
+
+func newS3Store(endpoint, region, bucket, accessKey, secretKey string, partSize int) (*s3Store, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.New("s3: endpoint must be an absolute URL: " + endpoint)
+	}
+	if bucket == "" {
+		return nil, errors.New("s3: bucket is required")
+	}
+	if partSize < s3MinPartSize {
+		partSize = s3MinPartSize
+	}
+	return &s3Store{u, region, bucket, accessKey, secretKey, partSize, &http.Client{}}, nil
+}
+
+func (s *s3Store) Assign(id string) (string, error) {
+	return "s3://" + s.bucket + "/" + id, nil
+}
+
+// Put uploads r with a single PUT when it fits in one part and falls back to
+// a multipart upload otherwise.
+func (s *s3Store) Put(location string, name string, r io.Reader) error {
+	bucket, key, err := s.parse(location)
+	if err != nil {
+		return err
+	}
+	first, err := readPart(r, s.partSize)
+	if err != nil {
+		return err
+	}
+	contentType := http.DetectContentType(first)
+	if len(first) < s.partSize {
+		header := http.Header{"Content-Type": {contentType}}
+		res, err := s.do("PUT", bucket, key, nil, header, first, -1, -1)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		return nil
+	}
+	return s.putMultipart(bucket, key, contentType, first, r)
+}
+
+type s3InitiateResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+func (s *s3Store) putMultipart(bucket, key, contentType string, first []byte, r io.Reader) error {
+	header := http.Header{"Content-Type": {contentType}}
+	res, err := s.do("POST", bucket, key, url.Values{"uploads": {""}}, header, nil, -1, -1)
+	if err != nil {
+		return err
+	}
+	var initiated s3InitiateResult
+	err = xml.NewDecoder(res.Body).Decode(&initiated)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	uploadId := initiated.UploadId
+	abort := func(err error) error {
+		res, abortErr := s.do("DELETE", bucket, key, url.Values{"uploadId": {uploadId}}, nil, nil, -1, -1)
+		if abortErr == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	var complete s3CompleteUpload
+	part := first
+	for number := 1; len(part) > 0; number++ {
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadId}}
+		res, err := s.do("PUT", bucket, key, query, nil, part, -1, -1)
+		if err != nil {
+			return abort(err)
+		}
+		res.Body.Close()
+		complete.Parts = append(complete.Parts, s3CompletePart{number, res.Header.Get("ETag")})
+		if len(part) < s.partSize {
+			break
+		}
+		part, err = readPart(r, s.partSize)
+		if err != nil {
+			return abort(err)
+		}
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return abort(err)
+	}
+	res, err = s.do("POST", bucket, key, url.Values{"uploadId": {uploadId}}, nil, body, -1, -1)
+	if err != nil {
+		return abort(err)
+	}
+	defer res.Body.Close()
+	// S3 may report a failed completion with a 200 status and an error body.
+	reply, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return abort(err)
+	}
+	if bytes.Contains(reply, []byte("<Error>")) {
+		return abort(fmt.Errorf("s3: complete multipart upload: %s", reply))
+	}
+	return nil
+}
+
+func (s *s3Store) Get(location string) (*Blob, error) {
+	return s.GetRange(location, 0, -1)
+}
+
+// GetRange reads length bytes starting at offset. A negative length reads to
+// the end of the blob.
+func (s *s3Store) GetRange(location string, offset, length int64) (*Blob, error) {
+	bucket, key, err := s.parse(location)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do("GET", bucket, key, nil, nil, nil, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return &Blob{s3BlobInfo(res), res.Body}, nil
+}
+
+// DirectURL presigns a GET of the object, asking S3 to answer with the
+// given Content-Type and Content-Disposition.
+func (s *s3Store) DirectURL(location string, ttl time.Duration, header http.Header) (string, bool, error) {
+	bucket, key, err := s.parse(location)
+	if err != nil {
+		return "", false, err
+	}
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + "/" + key
+	u.RawPath = s3EncodeURI(u.Path, false)
+	query := url.Values{}
+	if v := header.Get("Content-Type"); v != "" {
+		query.Set("response-content-type", v)
+	}
+	if v := header.Get("Content-Disposition"); v != "" {
+		query.Set("response-content-disposition", v)
+	}
+	u.RawQuery = query.Encode()
+	presignV4(&u, "s3", s.region, s.accessKey, s.secretKey, ttl, time.Now())
+	return u.String(), true, nil
+}
+
+func (s *s3Store) Delete(location string) error {
+	bucket, key, err := s.parse(location)
+	if err != nil {
+		return err
+	}
+	// S3 answers 204 whether or not the key existed.
+	_, err = s.Stat(location)
+	if err != nil {
+		return err
+	}
+	res, err := s.do("DELETE", bucket, key, nil, nil, nil, -1, -1)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *s3Store) Stat(location string) (*BlobInfo, error) {
+	bucket, key, err := s.parse(location)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do("HEAD", bucket, key, nil, nil, nil, -1, -1)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	info := s3BlobInfo(res)
+	return &info, nil
+}
+
+func (s *s3Store) parse(location string) (bucket, key string, err error) {
+	if !strings.HasPrefix(location, "s3://") {
+		return "", "", errors.New("s3: unsupported location " + location)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(location, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("s3: invalid location " + location)
+	}
+	return parts[0], parts[1], nil
+}
+
+// do sends a signed request for an object. When offset is not negative a
+// Range header is added. Responses with an error status are turned into
+// errors and their body is closed.
+func (s *s3Store) do(method, bucket, key string, query url.Values, header http.Header, body []byte, offset, length int64) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + "/" + key
+	// Sent encoded exactly as signed; net/url would leave + and the like.
+	u.RawPath = s3EncodeURI(u.Path, false)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if offset >= 0 && (offset > 0 || length >= 0) {
+		if length >= 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+	}
+	payloadHash := s3EmptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signV4(req, "s3", s.region, s.accessKey, s.secretKey, payloadHash, time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, errBlobNotFound
+	}
+	if res.StatusCode >= 400 {
+		str, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("s3: %s %s: %s: %s", method, key, res.Status, str)
+	}
+	return res, nil
+}
+
+func s3BlobInfo(res *http.Response) BlobInfo {
+	info := BlobInfo{ContentType: res.Header.Get("Content-Type")}
+	info.Size, _ = strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	info.ModTime, _ = time.Parse(http.TimeFormat, res.Header.Get("Last-Modified"))
+	return info
+}
+
+// readPart reads up to size bytes, returning fewer only at the end of r.
+func readPart(r io.Reader, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to req. The
+// host and every X-Amz-* header present on req are signed.
+func signV4(req *http.Request, service, region, accessKey, secretKey, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lower := strings.ToLower(k)
+		if strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EncodeURI(req.URL.Path, false),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// presignV4 adds AWS Signature Version 4 query parameters to u, making it
+// usable for a GET without credentials for ttl, at most a week.
+func presignV4(u *url.URL, service, region, accessKey, secretKey string, ttl time.Duration, now time.Time) {
+	if ttl > 7*24*time.Hour {
+		ttl = 7 * 24 * time.Hour
+	}
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", accessKey+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(ttl/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		s3EncodeURI(u.Path, false),
+		s3CanonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	query.Set("X-Amz-Signature", hex.EncodeToString(hmacSHA256(key, stringToSign)))
+	u.RawQuery = s3CanonicalQuery(query)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3EncodeURI(k, true)+"="+s3EncodeURI(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3EncodeURI percent-encodes everything but the RFC 3986 unreserved
+// characters, and slashes unless encodeSlash is set.
+func s3EncodeURI(s string, encodeSlash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
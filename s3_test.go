@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-process S3 server holding objects in memory. It checks
+// every request's Signature Version 4, from the Authorization header or the
+// query of a presigned URL, with its own implementation of the algorithm.
+type fakeS3 struct {
+	secretKey string
+	mu        sync.Mutex
+	objects   map[string][]byte
+	uploads   map[string]map[int][]byte
+	requests  []string
+	failPart  int
+}
+
+func newFakeS3(secretKey string) *fakeS3 {
+	return &fakeS3{secretKey: secretKey, objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	if problem := f.verify(r, body); problem != "" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "<Error><Code>SignatureDoesNotMatch</Code><Message>%s</Message></Error>", problem)
+		return
+	}
+	query := r.URL.Query()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path+" "+r.Header.Get("Range"))
+	switch {
+	case r.Method == "POST" && query["uploads"] != nil:
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == "PUT" && query.Get("partNumber") != "":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts := f.uploads[query.Get("uploadId")]
+		if parts == nil || number == f.failPart {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		parts[number] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"part%d"`, number))
+	case r.Method == "POST" && query.Get("uploadId") != "":
+		var complete s3CompleteUpload
+		xml.Unmarshal(body, &complete)
+		parts := f.uploads[query.Get("uploadId")]
+		var object []byte
+		for i, part := range complete.Parts {
+			if part.PartNumber != i+1 || part.ETag != fmt.Sprintf(`"part%d"`, i+1) || parts[part.PartNumber] == nil {
+				// S3 reports failed completions with a 200.
+				fmt.Fprint(w, "<Error><Code>InvalidPart</Code></Error>")
+				return
+			}
+			object = append(object, parts[part.PartNumber]...)
+		}
+		f.objects[r.URL.Path] = object
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult/>")
+	case r.Method == "DELETE" && query.Get("uploadId") != "":
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PUT":
+		f.objects[r.URL.Path] = body
+	case r.Method == "GET" || r.Method == "HEAD":
+		object, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if contentType := query.Get("response-content-type"); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		http.ServeContent(w, r, "", time.Unix(1e9, 0), bytes.NewReader(object))
+	case r.Method == "DELETE":
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// verify answers what is wrong with the signature of r, if anything.
+func (f *fakeS3) verify(r *http.Request, body []byte) string {
+	query := r.URL.Query()
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		fields := strings.Split(strings.TrimPrefix(authorization, "AWS4-HMAC-SHA256 "), ", ")
+		for _, field := range fields {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				return "malformed authorization"
+			}
+			switch parts[0] {
+			case "Credential":
+				credential = parts[1]
+			case "SignedHeaders":
+				signedHeaders = parts[1]
+			case "Signature":
+				signature = parts[1]
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		sum := sha256.Sum256(body)
+		if payloadHash != hex.EncodeToString(sum[:]) {
+			return "payload hash mismatch"
+		}
+	} else if query.Get("X-Amz-Signature") != "" {
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = "UNSIGNED-PAYLOAD"
+		signed, err := time.Parse("20060102T150405Z", amzDate)
+		expires, _ := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || time.Now().After(signed.Add(time.Duration(expires)*time.Second)) {
+			return "expired"
+		}
+		query.Del("X-Amz-Signature")
+	} else {
+		return "not signed"
+	}
+
+	scope := strings.SplitN(credential, "/", 2)
+	if len(scope) != 2 {
+		return "malformed credential"
+	}
+	var headers bytes.Buffer
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, awsEscape(name, true)+"="+awsEscape(value, true))
+		}
+	}
+	sort.Strings(params)
+	canonical := strings.Join([]string{
+		r.Method,
+		awsEscape(r.URL.Path, false),
+		strings.Join(params, "&"),
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	hashed := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope[1] + "\n" + hex.EncodeToString(hashed[:])
+	key := []byte("AWS4" + f.secretKey)
+	for _, part := range strings.Split(scope[1], "/") {
+		key = sign(key, part)
+	}
+	if hex.EncodeToString(sign(key, stringToSign)) != signature {
+		return "signature mismatch"
+	}
+	if r.URL.EscapedPath() != awsEscape(r.URL.Path, false) {
+		return "path sent differently than signed: " + r.URL.EscapedPath()
+	}
+	return ""
+}
+
+func sign(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscape is the URI encoding of Signature Version 4, written here apart
+// from s3EncodeURI so that the two check each other.
+func awsEscape(s string, slash bool) string {
+	escaped := url.QueryEscape(s)
+	escaped = strings.Replace(escaped, "+", "%20", -1)
+	escaped = strings.Replace(escaped, "%7E", "~", -1)
+	if !slash {
+		escaped = strings.Replace(escaped, "%2F", "/", -1)
+	}
+	return escaped
+}
+
+func TestSignV4(t *testing.T) {
+	// get-vanilla from the AWS Signature Version 4 test suite.
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	signV4(req, "service", "us-east-1", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", s3EmptyPayloadHash, now)
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Fatalf("Authorization: %s", got)
+	}
+}
+
+func newTestS3Store(t *testing.T, secretKey string) (*s3Store, *fakeS3, func()) {
+	fake := newFakeS3("secret")
+	srv := httptest.NewServer(fake)
+	store, err := newS3Store(srv.URL, "eu-west-1", "bucket", "access", secretKey, 0)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return store, fake, srv.Close
+}
+
+// blobReader reads whole the blobs returned by a store, failing t on any
+// error.
+func blobReader(t *testing.T) func(*Blob, error) string {
+	return func(blob *Blob, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer blob.Close()
+		content, err := ioutil.ReadAll(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+}
+
+func TestS3StoreSignature(t *testing.T) {
+	store, _, cleanup := newTestS3Store(t, "wrong")
+	defer cleanup()
+	err := store.Put("s3://bucket/a", "a", strings.NewReader("hello"))
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("wrong key: %v", err)
+	}
+}
+
+func TestS3StorePutGet(t *testing.T) {
+	store, fake, cleanup := newTestS3Store(t, "secret")
+	defer cleanup()
+	read := blobReader(t)
+	location := "s3://bucket/dir/a b+c~.txt"
+	err := store.Put(location, "a b+c~.txt", strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.requests) != 1 || !strings.HasPrefix(fake.requests[0], "PUT ") {
+		t.Fatalf("requests: %q", fake.requests)
+	}
+	if content := read(store.Get(location)); content != "hello world" {
+		t.Fatalf("content %q", content)
+	}
+	if content := read(store.GetRange(location, 6, 3)); content != "wor" {
+		t.Fatalf("range content %q", content)
+	}
+	if last := fake.requests[len(fake.requests)-1]; !strings.HasSuffix(last, "bytes=6-8") {
+		t.Fatalf("range request %q", last)
+	}
+	if content := read(store.GetRange(location, 6, -1)); content != "world" {
+		t.Fatalf("open range content %q", content)
+	}
+	info, err := store.Stat(location)
+	if err != nil || info.Size != 11 {
+		t.Fatalf("stat: %+v %v", info, err)
+	}
+
+	err = store.Delete(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Get(location); err != errBlobNotFound {
+		t.Fatalf("get after delete: %v", err)
+	}
+	if err = store.Delete(location); err != errBlobNotFound {
+		t.Fatalf("delete twice: %v", err)
+	}
+}
+
+func TestS3StoreDirectURL(t *testing.T) {
+	store, _, cleanup := newTestS3Store(t, "secret")
+	defer cleanup()
+	location := "s3://bucket/dir/a b+c.txt"
+	store.Put(location, "a", strings.NewReader("hello"))
+	link, expires, err := store.DirectURL(location, time.Minute, http.Header{"Content-Type": {"text/x-test"}})
+	if err != nil || !expires {
+		t.Fatalf("%v %v", expires, err)
+	}
+	res, err := http.Get(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "hello" || res.Header.Get("Content-Type") != "text/x-test" {
+		t.Fatalf("%d %q %s", res.StatusCode, body, res.Header.Get("Content-Type"))
+	}
+	res, err = http.Get(strings.Replace(link, "X-Amz-Expires=60", "X-Amz-Expires=600", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("tampered link: %d", res.StatusCode)
+	}
+}
+
+func TestS3StoreMultipart(t *testing.T) {
+	store, fake, cleanup := newTestS3Store(t, "secret")
+	defer cleanup()
+	read := blobReader(t)
+	for _, size := range []int{2*store.partSize + 1000, 2 * store.partSize} {
+		content := bytes.Repeat([]byte("0123456789"), size/10)
+		fake.requests = nil
+		err := store.Put("s3://bucket/big", "big", bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Initiate, the parts and complete.
+		parts := (size + store.partSize - 1) / store.partSize
+		if len(fake.requests) != parts+2 {
+			t.Fatalf("%d bytes: requests %q", size, fake.requests)
+		}
+		if got := read(store.Get("s3://bucket/big")); got != string(content) {
+			t.Fatalf("%d bytes: content differs", size)
+		}
+	}
+
+	fake.failPart = 2
+	fake.requests = nil
+	err := store.Put("s3://bucket/failed", "failed", bytes.NewReader(make([]byte, 2*store.partSize+1)))
+	if err == nil {
+		t.Fatal("failed part not reported")
+	}
+	if last := fake.requests[len(fake.requests)-1]; !strings.HasPrefix(last, "DELETE ") || len(fake.uploads) != 0 {
+		t.Fatalf("upload not aborted: %q", fake.requests)
+	}
+	if _, err = store.Stat("s3://bucket/failed"); err != errBlobNotFound {
+		t.Fatalf("stat of failed upload: %v", err)
+	}
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Share is a public link to a file. The password is kept as a PBKDF2 hash
+// and never answered.
+type Share struct {
+	Token        string     `json:"token"`
+	FileId       string     `json:"fileId"`
+	Url          string     `json:"url"`
+	PasswordHash string     `json:"passwordHash,omitempty"`
+	Protected    bool       `json:"protected"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	MaxDownloads int        `json:"maxDownloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	LastDownload *time.Time `json:"lastDownload,omitempty"`
+	Created      time.Time  `json:"created"`
+	Creator      string     `json:"creator,omitempty"`
+}
+
+// ShareRequest describes a new share. ExpiresIn is in seconds; zero values
+// mean no password, no expiry and no download limit.
+type ShareRequest struct {
+	Password     string `json:"password,omitempty"`
+	ExpiresIn    int64  `json:"expiresIn,omitempty"`
+	MaxDownloads int    `json:"maxDownloads,omitempty"`
+}
+
+var (
+	errShareExpired   = errors.New("share expired")
+	errShareExhausted = errors.New("share download limit reached")
+	errSharePassword  = errors.New("invalid share password")
+)
+
+const (
+	sharePasswordIterations = 600000
+	// shareAccessTTL is how long the cookie handed out for a right
+	// password spares further requests the password.
+	shareAccessTTL    = time.Hour
+	shareAccessCookie = "share-access"
+	// A client address that got shareMaxFailedLogins passwords wrong may
+	// not try again until shareLoginWindow after the first of them.
+	shareMaxFailedLogins = 5
+	shareLoginWindow     = 15 * time.Minute
+)
+
+// shareResumeWindow is how long after the last counted download a share
+// that reached its limit still answers range requests, so that download
+// can be resumed.
+const shareResumeWindow = 24 * time.Hour
+
+func (f FileResource) registerShares(ws *restful.WebService) {
+	ws.Route(ws.POST("/{id}/shares").To(f.createShare))
+	ws.Route(ws.GET("/{id}/shares").To(f.listShares))
+	ws.Route(ws.DELETE("/{id}/shares/{token}").To(f.revokeShare))
+}
+
+// registerPublicShares serves shared files under /shares, where the token
+// and password are all the credentials needed.
+func (f FileResource) registerPublicShares(container *restful.Container) {
+	ws := new(restful.WebService)
+	ws.Path("/shares")
+	ws.Route(ws.GET("/{token}/download").To(f.downloadShare))
+	ws.Route(ws.GET("/{token}/fetch").To(f.downloadShare))
+	ws.Route(ws.HEAD("/{token}/download").To(f.downloadShare))
+	ws.Route(ws.HEAD("/{token}/fetch").To(f.downloadShare))
+	container.Add(ws)
+}
+
+// hashSharePassword derives a PBKDF2-HMAC-SHA256 key from the password,
+// kept as pbkdf2-sha256$iterations$salt$key.
+func hashSharePassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, sharePasswordIterations, sha256.Size)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%x$%x", sharePasswordIterations, salt, key), nil
+}
+
+func (s *Share) checkPassword(password string) bool {
+	if s.PasswordHash == "" {
+		return true
+	}
+	parts := strings.Split(s.PasswordHash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	key, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	derived := pbkdf2SHA256([]byte(password), salt, iterations, len(key))
+	return subtle.ConstantTimeCompare(derived, key) == 1
+}
+
+// pbkdf2SHA256 is PBKDF2 (RFC 8018) with HMAC-SHA256 as the PRF.
+func pbkdf2SHA256(password, salt []byte, iterations, size int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	var index [4]byte
+	for block := uint32(1); len(key) < size; block++ {
+		binary.BigEndian.PutUint32(index[:], block)
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(index[:])
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:size]
+}
+
+// check tells whether a download through the share may go on, the
+// password aside. Requests that are not counted may continue a download
+// the limit was reached with.
+func (s *Share) check(now time.Time, counted bool) error {
+	if s.Expires != nil && !now.Before(*s.Expires) {
+		return errShareExpired
+	}
+	if s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads {
+		if counted || s.LastDownload == nil || now.Sub(*s.LastDownload) > shareResumeWindow {
+			return errShareExhausted
+		}
+	}
+	return nil
+}
+
+// public is the share as answered to the people managing it.
+func (s *Share) public() *Share {
+	copy := *s
+	copy.Protected = s.PasswordHash != ""
+	copy.PasswordHash = ""
+	return &copy
+}
+
+func decodeShare(serialized []byte) (*Share, error) {
+	var share Share
+	err := json.Unmarshal(serialized, &share)
+	if err != nil {
+		return nil, err
+	}
+	return &share, nil
+}
+
+type sharesByCreation []*Share
+
+func (s sharesByCreation) Len() int           { return len(s) }
+func (s sharesByCreation) Less(i, j int) bool { return s[i].Created.Before(s[j].Created) }
+func (s sharesByCreation) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// shareFile gets the file of a share management request, answering the
+// error itself when there is none the caller may write.
+func (f FileResource) shareFile(request *restful.Request, response *restful.Response) *File {
+	file, err := f.meta.Get(request.PathParameter("id"))
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return nil
+	}
+	if file == nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "File not found!")
+		return nil
+	}
+	if !f.authorize(request, response, file, permWrite) {
+		return nil
+	}
+	return file
+}
+
+func (f FileResource) createShare(request *restful.Request, response *restful.Response) {
+	shareRequest := new(ShareRequest)
+	if request.Request.ContentLength != 0 {
+		err := request.ReadEntity(shareRequest)
+		if err != nil {
+			response.AddHeader("Content-Type", "text/plain")
+			response.WriteErrorString(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if shareRequest.ExpiresIn < 0 || shareRequest.MaxDownloads < 0 {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusBadRequest, "Invalid share!")
+		return
+	}
+	file := f.shareFile(request, response)
+	if file == nil {
+		return
+	}
+	if file.Deleted != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusGone, "File deleted!")
+		return
+	}
+
+	token := make([]byte, 24)
+	_, err := rand.Read(token)
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	share := &Share{
+		Token:        base64.RawURLEncoding.EncodeToString(token),
+		FileId:       file.Id,
+		MaxDownloads: shareRequest.MaxDownloads,
+		Created:      time.Now().UTC(),
+		Creator:      requestUser(request),
+	}
+	share.Url = "/shares/" + share.Token + "/download"
+	if shareRequest.ExpiresIn > 0 {
+		expires := share.Created.Add(time.Duration(shareRequest.ExpiresIn) * time.Second)
+		share.Expires = &expires
+	}
+	if shareRequest.Password != "" {
+		share.PasswordHash, err = hashSharePassword(shareRequest.Password)
+		if err != nil {
+			response.AddHeader("Content-Type", "text/plain")
+			response.WriteErrorString(http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	err = f.meta.PutShare(share)
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		log.Println(err)
+		return
+	}
+	response.WriteEntity(share.public())
+}
+
+func (f FileResource) listShares(request *restful.Request, response *restful.Response) {
+	file := f.shareFile(request, response)
+	if file == nil {
+		return
+	}
+	shares, err := f.meta.ListShares(file.Id)
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	public := []*Share{}
+	for _, share := range shares {
+		public = append(public, share.public())
+	}
+	response.WriteEntity(public)
+}
+
+func (f FileResource) revokeShare(request *restful.Request, response *restful.Response) {
+	file := f.shareFile(request, response)
+	if file == nil {
+		return
+	}
+	share, err := f.meta.GetShare(request.PathParameter("token"))
+	if err == nil && share != nil && share.FileId == file.Id {
+		err = f.meta.DeleteShare(share.Token)
+	} else if err == nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "Share not found!")
+		return
+	}
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// downloadShare serves the file of a share, counting the download once
+// the share has been checked. Only requests for the content from its
+// start count; HEAD, later ranges and 304 answers do not. The password
+// comes in the X-Share-Password header or the password query parameter,
+// or is vouched for by the access cookie.
+func (f FileResource) downloadShare(request *restful.Request, response *restful.Response) {
+	share, err := f.meta.GetShare(request.PathParameter("token"))
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	var file *File
+	if share != nil {
+		file, err = f.meta.Get(share.FileId)
+	}
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if file == nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "Share not found!")
+		return
+	}
+	if file.Deleted != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusGone, "File deleted!")
+		return
+	}
+	if expired(file) {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusGone, "File expired!")
+		return
+	}
+	password := request.HeaderParameter("X-Share-Password")
+	if password == "" {
+		password = request.QueryParameter("password")
+	}
+	now := time.Now().UTC()
+	counted := countsAsDownload(request.Request, file)
+	err = share.check(now, counted)
+	if err == nil && !f.hasShareAccess(request, share, now) {
+		client, _, _ := net.SplitHostPort(request.Request.RemoteAddr)
+		if wait := shareLogins.wait(client, now); wait > 0 {
+			response.AddHeader("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+			response.AddHeader("Content-Type", "text/plain")
+			response.WriteErrorString(http.StatusTooManyRequests, "Too many failed passwords!")
+			return
+		}
+		if password != "" && share.checkPassword(password) {
+			f.grantShareAccess(request, response, share, now)
+		} else {
+			if password != "" {
+				shareLogins.failed(client, now)
+			}
+			err = errSharePassword
+		}
+	}
+	if err == nil && counted {
+		share, err = f.meta.UpdateShare(share.Token, func(share *Share) error {
+			err := share.check(now, true)
+			if err != nil {
+				return err
+			}
+			share.Downloads++
+			share.LastDownload = &now
+			return nil
+		})
+	}
+	if err == errShareExpired {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusGone, "Share expired!")
+		return
+	}
+	if err == errShareExhausted {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusGone, "Download limit reached!")
+		return
+	}
+	if err == errSharePassword {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusUnauthorized, "Invalid password!")
+		return
+	}
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if share == nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "Share not found!")
+		return
+	}
+	request.SetAttribute(linkAttribute, true)
+	f.serveContent(request, response, file)
+}
+
+// hasShareAccess tells whether request may download through share without
+// giving the password: the share has none, or the request carries the
+// cookie handed out for it.
+func (f FileResource) hasShareAccess(request *restful.Request, share *Share, now time.Time) bool {
+	if share.PasswordHash == "" {
+		return true
+	}
+	cookie, err := request.Request.Cookie(shareAccessCookie)
+	if err != nil {
+		return false
+	}
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return false
+	}
+	return hmac.Equal([]byte(parts[1]), []byte(f.shareAccessSignature(share, parts[0])))
+}
+
+// grantShareAccess hands out the cookie that spares the following requests
+// for the share, such as those of a player seeking, the password.
+func (f FileResource) grantShareAccess(request *restful.Request, response *restful.Response, share *Share, now time.Time) {
+	if share.PasswordHash == "" {
+		return
+	}
+	expires := strconv.FormatInt(now.Add(shareAccessTTL).Unix(), 10)
+	http.SetCookie(response.ResponseWriter, &http.Cookie{
+		Name:     shareAccessCookie,
+		Value:    expires + "." + f.shareAccessSignature(share, expires),
+		Path:     "/shares/" + share.Token + "/",
+		MaxAge:   int(shareAccessTTL / time.Second),
+		Secure:   request.Request.TLS != nil,
+		HttpOnly: true,
+	})
+}
+
+// shareAccessSignature signs access to share until expires. It covers the
+// password hash, so the cookie only works for the password it was given
+// for. Without -url-signing-key the key is made up at startup, and the
+// cookies only work with the instance that handed them out.
+func (f FileResource) shareAccessSignature(share *Share, expires string) string {
+	key := f.signingKey
+	if len(key) == 0 {
+		key = processKey()
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(share.Token + "\n" + expires + "\n" + share.PasswordHash))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+var (
+	processKeyOnce  sync.Once
+	processKeyValue []byte
+)
+
+// processKey is a random key made up for the life of the process.
+func processKey() []byte {
+	processKeyOnce.Do(func() {
+		processKeyValue = make([]byte, 32)
+		_, err := rand.Read(processKeyValue)
+		if err != nil {
+			log.Fatal(err)
+		}
+	})
+	return processKeyValue
+}
+
+// loginLimiter counts the wrong share passwords of each client address
+// over windows of shareLoginWindow.
+type loginLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*loginFailures
+}
+
+type loginFailures struct {
+	count int
+	reset time.Time
+}
+
+var shareLogins = newLoginLimiter()
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{clients: make(map[string]*loginFailures)}
+}
+
+// wait is how long client has to wait before trying a password again.
+func (l *loginLimiter) wait(client string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	failures := l.clients[client]
+	if failures == nil || failures.count < shareMaxFailedLogins || !now.Before(failures.reset) {
+		return 0
+	}
+	return failures.reset.Sub(now)
+}
+
+func (l *loginLimiter) failed(client string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	failures := l.clients[client]
+	if failures == nil || !now.Before(failures.reset) {
+		if len(l.clients) >= 10000 {
+			for address, old := range l.clients {
+				if !now.Before(old.reset) {
+					delete(l.clients, address)
+				}
+			}
+		}
+		failures = &loginFailures{reset: now.Add(shareLoginWindow)}
+		l.clients[client] = failures
+	}
+	failures.count++
+}
+
+// countsAsDownload tells whether a share request is answered with the
+// content from its first byte, mirroring the checks of http.ServeContent.
+func countsAsDownload(r *http.Request, file *File) bool {
+	if r.Method != "GET" || notModified(r, file) {
+		return false
+	}
+	ranges := r.Header.Get("Range")
+	if ranges == "" || !rangeApplies(r, file) {
+		return true
+	}
+	size := int64(-1)
+	if file.Sha256 != "" || len(file.Chunks) > 0 {
+		size = file.Size
+	}
+	return rangeCoversStart(ranges, size)
+}
+
+// rangeCoversStart tells whether a Range header may be answered with the
+// first byte of content of the given size, -1 if unknown. Only a single
+// range starting later, or a suffix shorter than the content, does not.
+func rangeCoversStart(ranges string, size int64) bool {
+	ranges = strings.TrimSpace(ranges)
+	if !strings.HasPrefix(ranges, "bytes=") {
+		return true
+	}
+	var specs []string
+	for _, spec := range strings.Split(ranges[len("bytes="):], ",") {
+		if spec = strings.TrimSpace(spec); spec != "" {
+			specs = append(specs, spec)
+		}
+	}
+	if len(specs) != 1 {
+		return true
+	}
+	i := strings.Index(specs[0], "-")
+	if i < 0 {
+		return true
+	}
+	start, end := strings.TrimSpace(specs[0][:i]), strings.TrimSpace(specs[0][i+1:])
+	if start == "" {
+		suffix, err := strconv.ParseInt(end, 10, 64)
+		return err != nil || size < 0 || suffix >= size
+	}
+	offset, err := strconv.ParseInt(start, 10, 64)
+	return err != nil || offset <= 0
+}
+
+func notModified(r *http.Request, file *File) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		return strings.TrimSpace(match) == "*" ||
+			file.Sha256 != "" && strings.Contains(match, `"`+file.Sha256+`"`)
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && file.Uploaded != nil && !file.Uploaded.Truncate(time.Second).After(since)
+}
+
+func rangeApplies(r *http.Request, file *File) bool {
+	validator := r.Header.Get("If-Range")
+	if validator == "" {
+		return true
+	}
+	if strings.HasPrefix(validator, `"`) {
+		return file.Sha256 != "" && validator == `"`+file.Sha256+`"`
+	}
+	modified, err := http.ParseTime(validator)
+	return err == nil && file.Uploaded != nil && file.Uploaded.Truncate(time.Second).Equal(modified)
+}
+
+// dropShares revokes the shares of a file that is gone for good.
+func (f *FileResource) dropShares(id string) {
+	shares, err := f.meta.ListShares(id)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, share := range shares {
+		err = f.meta.DeleteShare(share.Token)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
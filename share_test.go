@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRangeCoversStart(t *testing.T) {
+	for _, c := range []struct {
+		ranges string
+		size   int64
+		covers bool
+	}{
+		{"bytes=0-", 5, true},
+		{"bytes=0-1", 5, true},
+		{"bytes=2-", 5, false},
+		{" bytes= 2-3 ", 5, false},
+		{"bytes=-2", 5, false},
+		{"bytes=-5", 5, true},
+		{"bytes=-999999999", 5, true},
+		{"bytes=-2", -1, true},
+		{"bytes=1-,0-0", 5, true},
+		{"bytes=2-3,4-", 5, true},
+		{"bytes=2-,", 5, false},
+		{"items=2-", 5, true},
+		{"bytes=x-", 5, true},
+	} {
+		if got := rangeCoversStart(c.ranges, c.size); got != c.covers {
+			t.Errorf("rangeCoversStart(%q, %d) = %v", c.ranges, c.size, got)
+		}
+	}
+}
+
+func TestShareDownloadLimit(t *testing.T) {
+	f, cleanup := newTestResource(t)
+	defer cleanup()
+	srv := newTestServer(f)
+	defer srv.Close()
+
+	uploaded := time.Now().UTC().Add(-time.Hour)
+	f.blobs.Put("blob", "a.txt", strings.NewReader("hello"))
+	f.meta.Put(&File{Id: "f1", Name: "a.txt", Status: "uploaded", Url: "blob", Size: 5, Sha256: "abc", Uploaded: &uploaded})
+	res, err := http.Post(srv.URL+"/files/f1/shares", "application/json", strings.NewReader(`{"maxDownloads":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var share Share
+	json.NewDecoder(res.Body).Decode(&share)
+	res.Body.Close()
+
+	get := func(method string, header ...string) (int, string) {
+		req, _ := http.NewRequest(method, srv.URL+share.Url, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	downloads := func() int {
+		current, _ := f.meta.GetShare(share.Token)
+		return current.Downloads
+	}
+
+	// Nothing here serves the first byte.
+	for _, header := range [][]string{
+		{"Range", "bytes=2-"},
+		{"Range", "bytes=-2"},
+		{"If-None-Match", `"abc"`},
+	} {
+		status, _ := get("GET", header...)
+		if status != http.StatusPartialContent && status != http.StatusNotModified {
+			t.Fatalf("%v: %d", header, status)
+		}
+	}
+	if status, _ := get("HEAD"); status != http.StatusOK {
+		t.Fatalf("HEAD: %d", status)
+	}
+	if n := downloads(); n != 0 {
+		t.Fatalf("%d downloads counted", n)
+	}
+
+	status, body := get("GET", "Range", "bytes=-999999999")
+	if status != http.StatusPartialContent || body != "hello" {
+		t.Fatalf("suffix range: %d %q", status, body)
+	}
+	if n := downloads(); n != 1 {
+		t.Fatalf("%d downloads counted", n)
+	}
+	for _, ranges := range []string{"bytes=-999999999", "bytes=1-,0-0", "bytes=0-"} {
+		if status, _ := get("GET", "Range", ranges); status != http.StatusGone {
+			t.Fatalf("%s past the limit: %d", ranges, status)
+		}
+	}
+	// The last counted download may still be resumed.
+	if status, body := get("GET", "Range", "bytes=3-"); status != http.StatusPartialContent || body != "lo" {
+		t.Fatalf("resume: %d %q", status, body)
+	}
+}
+
+func TestSharePassword(t *testing.T) {
+	f, cleanup := newTestResource(t)
+	defer cleanup()
+	srv := newTestServer(f)
+	defer srv.Close()
+	defer func(limiter *loginLimiter) { shareLogins = limiter }(shareLogins)
+	shareLogins = newLoginLimiter()
+
+	f.blobs.Put("blob", "a.txt", strings.NewReader("hello"))
+	f.meta.Put(&File{Id: "f1", Name: "a.txt", Status: "uploaded", Url: "blob", Size: 5, Sha256: "abc"})
+	res, err := http.Post(srv.URL+"/files/f1/shares", "application/json", strings.NewReader(`{"password":"pw"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var share Share
+	json.NewDecoder(res.Body).Decode(&share)
+	res.Body.Close()
+
+	get := func(password string, cookies ...*http.Cookie) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+share.Url, nil)
+		req.Header.Set("Range", "bytes=1-")
+		if password != "" {
+			req.Header.Set("X-Share-Password", password)
+		}
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	if res := get(""); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("without password: %d", res.StatusCode)
+	}
+	res = get("pw")
+	if res.StatusCode != http.StatusPartialContent || len(res.Cookies()) != 1 {
+		t.Fatalf("with password: %d %v", res.StatusCode, res.Cookies())
+	}
+	access := res.Cookies()[0]
+	if res := get("", access); res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("with cookie: %d", res.StatusCode)
+	}
+	forged := *access
+	forged.Value = strings.Replace(forged.Value, ".", "0.", 1)
+	if res := get("", &forged); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("with forged cookie: %d", res.StatusCode)
+	}
+
+	for i := 0; i < shareMaxFailedLogins; i++ {
+		if res := get("wrong"); res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("wrong password: %d", res.StatusCode)
+		}
+	}
+	res = get("pw")
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") == "" {
+		t.Fatalf("after failed passwords: %d", res.StatusCode)
+	}
+	// The share still works for others.
+	if res := get("", access); res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("with cookie after failed passwords: %d", res.StatusCode)
+	}
+	if wait := shareLogins.wait("192.0.2.1", time.Now()); wait != 0 {
+		t.Fatalf("other client waits %v", wait)
+	}
+	if wait := shareLogins.wait("127.0.0.1", time.Now().Add(shareLoginWindow)); wait != 0 {
+		t.Fatalf("waits %v after the window", wait)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/emicklei/go-restful"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultSignedURLTTL = time.Hour
+
+// SignedURLRequest asks for a download link valid for ExpiresIn seconds,
+// optionally only from IP and with Disposition "inline" or "attachment".
+type SignedURLRequest struct {
+	ExpiresIn   int64  `json:"expiresIn,omitempty"`
+	IP          string `json:"ip,omitempty"`
+	Disposition string `json:"disposition,omitempty"`
+}
+
+type SignedURL struct {
+	Url     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+const dispositionAttribute = "disposition"
+
+// linkAttribute marks requests let through by a signed or shared link
+// rather than the caller's own credentials.
+const linkAttribute = "link"
+
+func (f FileResource) registerSigned(ws *restful.WebService) {
+	ws.Route(ws.POST("/{id}/signed-url").To(f.signURL))
+}
+
+// signature is the HMAC of the parameters of a signed link, which are
+// empty when not used.
+func (f FileResource) signature(id, expires, ip, disposition string) string {
+	mac := hmac.New(sha256.New, f.signingKey)
+	mac.Write([]byte(id + "\n" + expires + "\n" + ip + "\n" + disposition))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedDownload tells whether request downloads a file with a signed link,
+// which stands in for authentication.
+func signedDownload(request *restful.Request) bool {
+	path := request.SelectedRoutePath()
+	return request.QueryParameter("signature") != "" &&
+		(path == "/files/{id}/download" || path == "/files/{id}/fetch")
+}
+
+// checkSignature answers 403 unless the signed link of request is genuine,
+// has not expired and is used from the address it was issued for.
+func (f FileResource) checkSignature(request *restful.Request, response *restful.Response) bool {
+	expires := request.QueryParameter("expires")
+	ip := request.QueryParameter("ip")
+	disposition := request.QueryParameter("disposition")
+	expected := f.signature(request.PathParameter("id"), expires, ip, disposition)
+	if len(f.signingKey) == 0 || !hmac.Equal([]byte(request.QueryParameter("signature")), []byte(expected)) {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusForbidden, "Invalid signature!")
+		return false
+	}
+	deadline, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() >= deadline {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusForbidden, "Link expired!")
+		return false
+	}
+	if ip != "" {
+		host, _, _ := net.SplitHostPort(request.Request.RemoteAddr)
+		if host != ip {
+			response.AddHeader("Content-Type", "text/plain")
+			response.WriteErrorString(http.StatusForbidden, "Link not valid from this address!")
+			return false
+		}
+	}
+	if disposition != "" {
+		request.SetAttribute(dispositionAttribute, disposition)
+	}
+	request.SetAttribute(linkAttribute, true)
+	return true
+}
+
+// signURL mints a signed download link for a caller who may read the file.
+func (f FileResource) signURL(request *restful.Request, response *restful.Response) {
+	if len(f.signingKey) == 0 {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotImplemented, "URL signing disabled!")
+		return
+	}
+	signing := new(SignedURLRequest)
+	if request.Request.ContentLength != 0 {
+		err := request.ReadEntity(signing)
+		if err != nil {
+			response.AddHeader("Content-Type", "text/plain")
+			response.WriteErrorString(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	ttl := time.Duration(signing.ExpiresIn) * time.Second
+	if signing.ExpiresIn == 0 {
+		ttl = defaultSignedURLTTL
+	}
+	if ttl <= 0 || f.maxSignedURLTTL > 0 && ttl > f.maxSignedURLTTL {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusBadRequest, "Invalid expiry!")
+		return
+	}
+	if signing.Disposition != "" && signing.Disposition != "inline" && signing.Disposition != "attachment" {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusBadRequest, "Invalid disposition!")
+		return
+	}
+	if signing.IP != "" && net.ParseIP(signing.IP) == nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusBadRequest, "Invalid IP address!")
+		return
+	}
+	file, err := f.meta.Get(request.PathParameter("id"))
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if file == nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "File not found!")
+		return
+	}
+	if !f.authorize(request, response, file, permRead) {
+		return
+	}
+	if file.Deleted != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusGone, "File deleted!")
+		return
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second).UTC()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	if signing.IP != "" {
+		query.Set("ip", signing.IP)
+	}
+	if signing.Disposition != "" {
+		query.Set("disposition", signing.Disposition)
+	}
+	query.Set("signature", f.signature(file.Id, query.Get("expires"), signing.IP, signing.Disposition))
+	path := strings.TrimSuffix(request.Request.URL.Path, "/signed-url") + "/download"
+	response.WriteEntity(&SignedURL{Url: path + "?" + query.Encode(), Expires: expires})
+}
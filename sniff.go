@@ -0,0 +1,38 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+)
+
+// sniffLen is how much of the content http.DetectContentType looks at.
+const sniffLen = 512
+
+// detectContentType sniffs the type of a file from its first bytes, falling
+// back to its extension when the bytes are not recognized.
+func detectContentType(name string, head []byte) string {
+	contentType := http.DetectContentType(head)
+	if contentType == "application/octet-stream" || contentType == "text/plain; charset=utf-8" {
+		if byExt := mime.TypeByExtension(filepath.Ext(name)); byExt != "" {
+			return byExt
+		}
+	}
+	return contentType
+}
+
+// headWriter keeps the first limit bytes written to it.
+type headWriter struct {
+	buf   []byte
+	limit int
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if room := w.limit - len(w.buf); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		w.buf = append(w.buf, p[:room]...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"github.com/emicklei/go-restful"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+var errFileNotDeleted = errors.New("file not deleted")
+
+// Deleted files stay in the trash for f.trashRetention, during which they
+// can be restored. Their records are kept with Deleted set, and they are
+// left out of listings and refused by the other endpoints with 410. The
+// purger deletes them for good once they expire.
+
+func (f FileResource) registerTrash(ws *restful.WebService) {
+	ws.Route(ws.POST("/{id}/restore").To(f.restoreFile))
+	ws.Route(ws.POST("/{id}/purge").To(f.purgeFile))
+}
+
+// restoreFile takes a file out of the trash.
+func (f *FileResource) restoreFile(request *restful.Request, response *restful.Response) {
+	id := request.PathParameter("id")
+	if !f.uploads.begin(id) {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusConflict, "Upload in progress!")
+		return
+	}
+	defer f.uploads.end(id)
+	identity := requestIdentity(request)
+	file, err := f.meta.Update(id, func(file *File) error {
+		if !allowed(identity, file, permDelete) {
+			return errAccessDenied
+		}
+		if file.Deleted == nil {
+			return errFileNotDeleted
+		}
+		file.Deleted = nil
+		file.Updated = time.Now().UTC()
+		return nil
+	})
+	if err == errAccessDenied {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusForbidden, "Access denied!")
+		return
+	}
+	if err == errFileNotDeleted {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusConflict, "File is not deleted!")
+		return
+	}
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if file == nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "File not found!")
+		return
+	}
+	response.WriteEntity(file)
+}
+
+// purgeFile deletes a file for good, whether it is in the trash or not.
+func (f *FileResource) purgeFile(request *restful.Request, response *restful.Response) {
+	id := request.PathParameter("id")
+	if !f.uploads.begin(id) {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusConflict, "Upload in progress!")
+		return
+	}
+	defer f.uploads.end(id)
+	f.purgeLocked(request, response)
+}
+
+// purgeLocked answers a request to delete a file for good. The caller must
+// hold the upload lock of the file.
+func (f *FileResource) purgeLocked(request *restful.Request, response *restful.Response) {
+	file, err := f.meta.Get(request.PathParameter("id"))
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if file == nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "File not found!")
+		return
+	}
+	if !f.authorize(request, response, file, permDelete) {
+		return
+	}
+	_, err = f.purge(file)
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// purge deletes the record and all content of file, and tells whether it
+// did. The content dropped is that of the record as it was deleted, and
+// nothing is dropped when another instance got to the record first. The
+// caller must hold the upload lock of the file.
+func (f *FileResource) purge(file *File) (bool, error) {
+	file, err := f.meta.Delete(file.Id)
+	if err != nil || file == nil {
+		return false, err
+	}
+	f.dropShares(file.Id)
+	// A resumable upload that is not currently receiving data is aborted.
+	err = os.Remove(f.uploads.stagingPath(file.Id))
+	if err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+	f.deleteContent(file)
+	return true, nil
+}
+
+// runPurger purges expired files from the trash every interval.
+func (f *FileResource) runPurger(interval time.Duration) {
+	for {
+		purged, err := f.purgeTrash(time.Now().Add(-f.trashRetention))
+		if err != nil {
+			log.Printf("purging trash: %v", err)
+		}
+		if purged > 0 {
+			log.Printf("Purged %d files from the trash", purged)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// purgeTrash purges the files deleted before cutoff. Files that are being
+// restored or changed in the meantime are left alone.
+func (f *FileResource) purgeTrash(cutoff time.Time) (int, error) {
+	purged := 0
+	q := &ListQuery{Trashed: true, DeletedBefore: cutoff, Limit: maxListLimit}
+	for {
+		list, err := f.meta.List(q)
+		if err != nil {
+			return purged, err
+		}
+		for _, file := range list.Files {
+			if !f.uploads.begin(file.Id) {
+				continue
+			}
+			current, err := f.meta.Get(file.Id)
+			if err == nil && current != nil && current.Deleted != nil && current.Deleted.Before(cutoff) {
+				var ok bool
+				ok, err = f.purge(current)
+				if ok {
+					purged++
+				}
+			}
+			f.uploads.end(file.Id)
+			if err != nil {
+				log.Printf("purging %s: %v", file.Id, err)
+			}
+		}
+		if list.Next == "" {
+			return purged, nil
+		}
+		q.Cursor = list.Next
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// ttlUnits are the units of TTLs, as understood by SeaweedFS.
+var ttlUnits = map[byte]time.Duration{
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+	'M': 30 * 24 * time.Hour,
+	'y': 365 * 24 * time.Hour,
+}
+
+// parseTTL parses a TTL such as "30m", "12h" or "7d": a count from 1 to 255
+// followed by one of the units m, h, d, w, M and y.
+func parseTTL(ttl string) (time.Duration, error) {
+	if len(ttl) < 2 {
+		return 0, fmt.Errorf("invalid ttl: %q", ttl)
+	}
+	unit, ok := ttlUnits[ttl[len(ttl)-1]]
+	count, err := strconv.Atoi(ttl[:len(ttl)-1])
+	if !ok || err != nil || count < 1 || count > 255 {
+		return 0, fmt.Errorf("invalid ttl: %q", ttl)
+	}
+	return time.Duration(count) * unit, nil
+}
+
+func expired(file *File) bool {
+	return file.Expires != nil && !time.Now().Before(*file.Expires)
+}
+
+// assign picks a location for content of fileInfo, letting the blob store
+// expire it by itself when it can.
+func (f *FileResource) assign(fileInfo *File, id string) (string, error) {
+	if expiring, ok := f.blobs.(ExpiringAssigner); ok && fileInfo.TTL != "" {
+		return expiring.AssignTTL(id, fileInfo.TTL)
+	}
+	return f.blobs.Assign(id)
+}
+
+// runSweeper deletes expired files every interval. Their content may have
+// been expired by the blob store already, but the records and the content
+// kept by other stores are only removed here.
+func (f *FileResource) runSweeper(interval time.Duration) {
+	for {
+		swept, err := f.sweepExpired(time.Now())
+		if err != nil {
+			log.Printf("deleting expired files: %v", err)
+		}
+		if swept > 0 {
+			log.Printf("Deleted %d expired files", swept)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// sweepExpired deletes the files that expired before now, in the trash or
+// not.
+func (f *FileResource) sweepExpired(now time.Time) (int, error) {
+	swept := 0
+	q := &ListQuery{ExpiredBefore: now, Limit: maxListLimit}
+	for {
+		list, err := f.meta.List(q)
+		if err != nil {
+			return swept, err
+		}
+		for _, file := range list.Files {
+			if !f.uploads.begin(file.Id) {
+				continue
+			}
+			current, err := f.meta.Get(file.Id)
+			if err == nil && current != nil && current.Expires != nil && current.Expires.Before(now) {
+				var ok bool
+				ok, err = f.purge(current)
+				if ok {
+					swept++
+				}
+			}
+			f.uploads.end(file.Id)
+			if err != nil {
+				log.Printf("deleting %s: %v", file.Id, err)
+			}
+		}
+		if list.Next == "" {
+			return swept, nil
+		}
+		q.Cursor = list.Next
+	}
+}
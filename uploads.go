@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const offsetStreamType = "application/offset+octet-stream"
+
+// uploadSessions tracks the uploads running in this process and stages the
+// bytes of resumable uploads on local disk until they are complete. The
+// staged file is the source of truth for the upload offset, so a session
+// picks up where it was after a restart.
+type uploadSessions struct {
+	dir    string
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+func newUploadSessions(dir string) (*uploadSessions, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadSessions{dir: dir, active: make(map[string]bool)}, nil
+}
+
+// begin marks an upload to id as running. It returns false if one already
+// is, in which case the caller must not touch the file.
+func (u *uploadSessions) begin(id string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.active[id] {
+		return false
+	}
+	u.active[id] = true
+	return true
+}
+
+func (u *uploadSessions) end(id string) {
+	u.mu.Lock()
+	delete(u.active, id)
+	u.mu.Unlock()
+}
+
+func (u *uploadSessions) stagingPath(id string) string {
+	return filepath.Join(u.dir, id+".part")
+}
+
+// offset returns how many bytes of the upload to id have been staged, and
+// false if there is no session for it.
+func (u *uploadSessions) offset(id string) (int64, bool, error) {
+	stat, err := os.Stat(u.stagingPath(id))
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return stat.Size(), true, nil
+}
+
+func (f FileResource) registerUploads(ws *restful.WebService) {
+	ws.Route(ws.POST("/{id}/uploads").To(f.createUpload))
+	ws.Route(ws.HEAD("/{id}/uploads").To(f.uploadOffset))
+	ws.Route(ws.PATCH("/{id}/uploads").To(f.patchUpload).Consumes(offsetStreamType))
+	ws.Route(ws.POST("/{id}/uploads/complete").To(f.completeUpload))
+}
+
+// createUpload starts a resumable upload session for a file. The total size
+// is given in the Upload-Length header. Any earlier session is discarded.
+func (f *FileResource) createUpload(request *restful.Request, response *restful.Response) {
+	fileInfo, err := f.meta.Get(request.PathParameter("id"))
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if fileInfo == nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "File not found!")
+		return
+	}
+	if !f.authorize(request, response, fileInfo, permWrite) {
+		return
+	}
+	if fileInfo.Deleted != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusGone, "File deleted!")
+		return
+	}
+	size, err := strconv.ParseInt(request.HeaderParameter("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusBadRequest, "Invalid Upload-Length!")
+		return
+	}
+	if !f.uploads.begin(fileInfo.Id) {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusConflict, "Upload in progress!")
+		return
+	}
+	defer f.uploads.end(fileInfo.Id)
+
+	staging, err := os.Create(f.uploads.stagingPath(fileInfo.Id))
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	staging.Close()
+	fileInfo.Status = "uploading"
+	fileInfo.Progress = 0
+	fileInfo.UploadLength = size
+	fileInfo.Offset = 0
+	err = f.saveUpload(fileInfo)
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	response.AddHeader("Location", request.Request.URL.Path)
+	response.AddHeader("Upload-Offset", "0")
+	response.ResponseWriter.WriteHeader(http.StatusCreated)
+}
+
+func (f FileResource) uploadOffset(request *restful.Request, response *restful.Response) {
+	fileInfo, err := f.meta.Get(request.PathParameter("id"))
+	if err != nil {
+		response.ResponseWriter.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if fileInfo == nil {
+		response.ResponseWriter.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !allowed(requestIdentity(request), fileInfo, permWrite) {
+		response.ResponseWriter.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if fileInfo.Deleted != nil {
+		response.ResponseWriter.WriteHeader(http.StatusGone)
+		return
+	}
+	offset, ok, err := f.uploads.offset(fileInfo.Id)
+	if err != nil {
+		response.ResponseWriter.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		response.ResponseWriter.WriteHeader(http.StatusNotFound)
+		return
+	}
+	response.AddHeader("Upload-Offset", strconv.FormatInt(offset, 10))
+	response.AddHeader("Upload-Length", strconv.FormatInt(fileInfo.UploadLength, 10))
+	response.AddHeader("Cache-Control", "no-store")
+	response.ResponseWriter.WriteHeader(http.StatusOK)
+}
+
+// patchUpload appends the request body to a session. Upload-Offset must
+// match the current offset so that a chunk is never written twice.
+func (f *FileResource) patchUpload(request *restful.Request, response *restful.Response) {
+	fileInfo, err := f.meta.Get(request.PathParameter("id"))
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if fileInfo == nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "File not found!")
+		return
+	}
+	if !f.authorize(request, response, fileInfo, permWrite) {
+		return
+	}
+	if fileInfo.Deleted != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusGone, "File deleted!")
+		return
+	}
+	if !f.uploads.begin(fileInfo.Id) {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusConflict, "Upload in progress!")
+		return
+	}
+	defer f.uploads.end(fileInfo.Id)
+
+	offset, ok, err := f.uploads.offset(fileInfo.Id)
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "Upload session not found!")
+		return
+	}
+	requested, err := strconv.ParseInt(request.HeaderParameter("Upload-Offset"), 10, 64)
+	if err != nil || requested != offset {
+		response.AddHeader("Upload-Offset", strconv.FormatInt(offset, 10))
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusConflict, "Upload-Offset does not match!")
+		return
+	}
+
+	staging, err := os.OpenFile(f.uploads.stagingPath(fileInfo.Id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	var written int64
+	counter := &countingWriter{staging, &written}
+	stop := f.trackProgress(fileInfo.Id, func() float32 {
+		if fileInfo.UploadLength == 0 {
+			return 0
+		}
+		return float32(offset+atomic.LoadInt64(&written)) / float32(fileInfo.UploadLength)
+	})
+	_, err = io.Copy(counter, io.LimitReader(request.Request.Body, fileInfo.UploadLength-offset))
+	if closeErr := staging.Close(); err == nil {
+		err = closeErr
+	}
+	stop()
+	fileInfo.Offset = offset + written
+	if fileInfo.UploadLength > 0 {
+		fileInfo.Progress = float32(fileInfo.Offset) / float32(fileInfo.UploadLength)
+	}
+	saveErr := f.saveUpload(fileInfo)
+	if saveErr != nil {
+		log.Println(saveErr)
+	}
+	response.AddHeader("Upload-Offset", strconv.FormatInt(fileInfo.Offset, 10))
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if n, _ := request.Request.Body.Read(make([]byte, 1)); n > 0 {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusRequestEntityTooLarge, "Chunk exceeds Upload-Length!")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// completeUpload moves a fully staged upload into the blob store.
+func (f *FileResource) completeUpload(request *restful.Request, response *restful.Response) {
+	fileInfo, err := f.meta.Get(request.PathParameter("id"))
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if fileInfo == nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "File not found!")
+		return
+	}
+	if !f.authorize(request, response, fileInfo, permWrite) {
+		return
+	}
+	if fileInfo.Deleted != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusGone, "File deleted!")
+		return
+	}
+	if !f.uploads.begin(fileInfo.Id) {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusConflict, "Upload in progress!")
+		return
+	}
+	defer f.uploads.end(fileInfo.Id)
+
+	offset, ok, err := f.uploads.offset(fileInfo.Id)
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "Upload session not found!")
+		return
+	}
+	expected, err := parseDigests(request.Request.Header)
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+	if offset != fileInfo.UploadLength {
+		response.AddHeader("Upload-Offset", strconv.FormatInt(offset, 10))
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusConflict, fmt.Sprintf("Upload incomplete: %d of %d bytes", offset, fileInfo.UploadLength))
+		return
+	}
+	staging, err := os.Open(f.uploads.stagingPath(fileInfo.Id))
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	previous := *fileInfo
+	err = f.storeContent(fileInfo, fileInfo.Name, staging)
+	staging.Close()
+	if err != nil {
+		// The staged bytes are kept so that completing can be retried.
+		f.discardContent(fileInfo)
+		currentVersion(&previous).apply(fileInfo)
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	status := http.StatusBadRequest
+	err = verifyDigests(fileInfo, expected)
+	if err == nil {
+		status = http.StatusInternalServerError
+		err = f.shareContent(fileInfo)
+	}
+	if err != nil {
+		f.discardContent(fileInfo)
+		currentVersion(&previous).apply(fileInfo)
+		fileInfo.Status = "failed"
+		saveErr := f.saveUpload(fileInfo)
+		if saveErr != nil {
+			log.Println(saveErr)
+		}
+		os.Remove(f.uploads.stagingPath(fileInfo.Id))
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(status, err.Error())
+		return
+	}
+	markUploaded(fileInfo, request)
+	fileInfo.Offset = fileInfo.Size
+	pruned := f.keepVersion(fileInfo, &previous)
+	err = f.saveUpload(fileInfo)
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	f.dropVersions(fileInfo, pruned)
+	err = os.Remove(f.uploads.stagingPath(fileInfo.Id))
+	if err != nil {
+		log.Println(err)
+	}
+	response.WriteHeader(http.StatusOK)
+	response.WriteEntity(fileInfo)
+}
+
+type countingReader struct {
+	io.Reader
+	count *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	io.Writer
+	count *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	atomic.AddInt64(w.count, int64(n))
+	return n, err
+}
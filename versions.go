@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"github.com/emicklei/go-restful"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// FileVersion is the content of one successful upload of a file. The
+// current version is described by the File itself, and the versions it
+// replaced are kept in File.Versions, oldest first, each holding on to its
+// own content until it is pruned.
+type FileVersion struct {
+	Version     int        `json:"version"`
+	Url         string     `json:"url"`
+	Size        int64      `json:"size,omitempty"`
+	Chunks      []Chunk    `json:"chunks,omitempty"`
+	Sha256      string     `json:"sha256,omitempty"`
+	Md5         string     `json:"md5,omitempty"`
+	ContentType string     `json:"contentType,omitempty"`
+	Uploaded    *time.Time `json:"uploaded,omitempty"`
+	Uploader    string     `json:"uploader,omitempty"`
+}
+
+var errVersionNotFound = errors.New("version not found")
+
+type VersionList struct {
+	Current  int           `json:"current"`
+	Versions []FileVersion `json:"versions"`
+}
+
+// hasContent tells whether a file has been uploaded successfully, before
+// versions were numbered or since.
+func hasContent(file *File) bool {
+	return file.Version > 0 || file.Uploaded != nil || file.Status == "uploaded"
+}
+
+func currentVersion(file *File) FileVersion {
+	v := FileVersion{
+		Version:     file.Version,
+		Url:         file.Url,
+		Size:        file.Size,
+		Chunks:      file.Chunks,
+		Sha256:      file.Sha256,
+		Md5:         file.Md5,
+		ContentType: file.ContentType,
+		Uploaded:    file.Uploaded,
+		Uploader:    file.Uploader,
+	}
+	if v.Version == 0 && hasContent(file) {
+		// Uploaded before versions were numbered.
+		v.Version = 1
+	}
+	return v
+}
+
+// apply makes v the content of file.
+func (v FileVersion) apply(file *File) {
+	file.Version = v.Version
+	file.Url = v.Url
+	file.Size = v.Size
+	file.Chunks = v.Chunks
+	file.Sha256 = v.Sha256
+	file.Md5 = v.Md5
+	file.ContentType = v.ContentType
+	file.Uploaded = v.Uploaded
+	file.Uploader = v.Uploader
+}
+
+// of returns a copy of file with v as its content.
+func (v FileVersion) of(file *File) *File {
+	copy := *file
+	v.apply(&copy)
+	copy.Versions = nil
+	return &copy
+}
+
+// keepVersion numbers the content just uploaded to fileInfo and moves what
+// was current before the upload, previous, to the past versions. It returns
+// the versions beyond the retention limit, which have been removed from
+// fileInfo and must be passed to dropVersions once fileInfo is saved.
+func (f *FileResource) keepVersion(fileInfo, previous *File) []FileVersion {
+	if !hasContent(previous) {
+		fileInfo.Version = 1
+		return nil
+	}
+	fileInfo.Versions = append(append([]FileVersion(nil), previous.Versions...), currentVersion(previous))
+	fileInfo.Version = 0
+	for _, v := range fileInfo.Versions {
+		if v.Version > fileInfo.Version {
+			fileInfo.Version = v.Version
+		}
+	}
+	fileInfo.Version++
+	return f.pruneVersions(fileInfo)
+}
+
+func (f *FileResource) pruneVersions(fileInfo *File) []FileVersion {
+	if f.maxVersions <= 0 || len(fileInfo.Versions) < f.maxVersions {
+		return nil
+	}
+	excess := len(fileInfo.Versions) - f.maxVersions + 1
+	pruned := fileInfo.Versions[:excess]
+	fileInfo.Versions = append([]FileVersion(nil), fileInfo.Versions[excess:]...)
+	return pruned
+}
+
+// dropVersions deletes the content of versions of file that are no longer
+// kept.
+func (f *FileResource) dropVersions(file *File, versions []FileVersion) {
+	for _, v := range versions {
+		f.deleteContent(v.of(file))
+	}
+}
+
+func (f FileResource) registerVersions(ws *restful.WebService) {
+	ws.Route(ws.GET("/{id}/versions").To(f.listVersions))
+	ws.Route(ws.GET("/{id}/versions/{version}/download").To(f.downloadVersion))
+	ws.Route(ws.GET("/{id}/versions/{version}/fetch").To(f.downloadVersion))
+	ws.Route(ws.HEAD("/{id}/versions/{version}/download").To(f.downloadVersion))
+	ws.Route(ws.HEAD("/{id}/versions/{version}/fetch").To(f.downloadVersion))
+	ws.Route(ws.POST("/{id}/versions/{version}/restore").To(f.restoreVersion))
+}
+
+// listVersions answers the versions of a file, newest first.
+func (f FileResource) listVersions(request *restful.Request, response *restful.Response) {
+	file, err := f.meta.Get(request.PathParameter("id"))
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if file == nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "File not found!")
+		return
+	}
+	if !f.authorize(request, response, file, permRead) {
+		return
+	}
+	if file.Deleted != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusGone, "File deleted!")
+		return
+	}
+	current := currentVersion(file)
+	list := &VersionList{Current: current.Version, Versions: append([]FileVersion{}, file.Versions...)}
+	if hasContent(file) {
+		list.Versions = append(list.Versions, current)
+	}
+	sort.Sort(sort.Reverse(versionsByNumber(list.Versions)))
+	response.WriteEntity(list)
+}
+
+func (f FileResource) downloadVersion(request *restful.Request, response *restful.Response) {
+	file, err := f.meta.Get(request.PathParameter("id"))
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if file == nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "File not found!")
+		return
+	}
+	if !f.authorize(request, response, file, permRead) {
+		return
+	}
+	if file.Deleted != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusGone, "File deleted!")
+		return
+	}
+	if expired(file) {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusGone, "File expired!")
+		return
+	}
+	v, ok := findVersion(file, request.PathParameter("version"))
+	if !ok {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "Version not found!")
+		return
+	}
+	f.serveContent(request, response, v.of(file))
+}
+
+// restoreVersion makes a past version current again. The version that was
+// current takes its place among the past versions, so nothing is lost.
+func (f *FileResource) restoreVersion(request *restful.Request, response *restful.Response) {
+	id := request.PathParameter("id")
+	if !f.uploads.begin(id) {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusConflict, "Upload in progress!")
+		return
+	}
+	defer f.uploads.end(id)
+	identity := requestIdentity(request)
+	file, err := f.meta.Update(id, func(file *File) error {
+		if !allowed(identity, file, permWrite) {
+			return errAccessDenied
+		}
+		if file.Deleted != nil {
+			return errFileDeleted
+		}
+		v, ok := findVersion(file, request.PathParameter("version"))
+		if !ok {
+			return errVersionNotFound
+		}
+		current := currentVersion(file)
+		if v.Version == current.Version {
+			return nil
+		}
+		var versions []FileVersion
+		for _, past := range file.Versions {
+			if past.Version != v.Version {
+				versions = append(versions, past)
+			}
+		}
+		versions = append(versions, current)
+		v.apply(file)
+		file.Versions = versions
+		file.Status = "uploaded"
+		file.Progress = 100
+		file.Updated = time.Now().UTC()
+		return nil
+	})
+	if err == errAccessDenied {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusForbidden, "Access denied!")
+		return
+	}
+	if err == errFileDeleted {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusGone, "File deleted!")
+		return
+	}
+	if err == errVersionNotFound {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "Version not found!")
+		return
+	}
+	if err != nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if file == nil {
+		response.AddHeader("Content-Type", "text/plain")
+		response.WriteErrorString(http.StatusNotFound, "File not found!")
+		return
+	}
+	response.WriteEntity(file)
+}
+
+func findVersion(file *File, version string) (FileVersion, bool) {
+	n, err := strconv.Atoi(version)
+	if err != nil {
+		return FileVersion{}, false
+	}
+	if current := currentVersion(file); n == current.Version && hasContent(file) {
+		return current, true
+	}
+	for _, v := range file.Versions {
+		if v.Version == n {
+			return v, true
+		}
+	}
+	return FileVersion{}, false
+}
+
+type versionsByNumber []FileVersion
+
+func (s versionsByNumber) Len() int           { return len(s) }
+func (s versionsByNumber) Less(i, j int) bool { return s[i].Version < s[j].Version }
+func (s versionsByNumber) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type WeedInfo struct {
+	Fid       string `json:"fid"`
+	Url       string `json:"url"`
+	PublicUrl string `json:"publicUrl"`
+	Error     string `json:"error"`
+}
+
+type weedLookup struct {
+	Locations []weedLocation `json:"locations"`
+	Error     string         `json:"error"`
+}
+
+type weedLocation struct {
+	Url       string `json:"url"`
+	PublicUrl string `json:"publicUrl"`
+}
+
+type weedVolume struct {
+	locations []weedLocation
+	expires   time.Time
+}
+
+// weedLookupTTL is how long the locations of a volume are trusted before
+// the master is asked again.
+const weedLookupTTL = 10 * time.Minute
+
+// weedStore keeps blobs on a SeaweedFS cluster. Locations are fids, with
+// the ttl of expiring blobs appended as a query. The volume servers holding
+// a fid are looked up on the master and cached, so volumes may move; the
+// volume server URLs recorded by earlier versions are only used for their
+// fid.
+type weedStore struct {
+	masterUrl string
+	client    *http.Client
+	mu        sync.Mutex
+	volumes   map[string]weedVolume
+}
+
+func newWeedStore(masterUrl string) *weedStore {
+	return &weedStore{masterUrl: masterUrl, client: &http.Client{}, volumes: make(map[string]weedVolume)}
+}
+
+func (s *weedStore) Assign(id string) (string, error) {
+	return s.assign("")
+}
+
+// AssignTTL assigns a fid on a volume of blobs expiring after ttl. The ttl
+// has to be passed again when writing the blob, so it is kept in the
+// location.
+func (s *weedStore) AssignTTL(id, ttl string) (string, error) {
+	location, err := s.assign(ttl)
+	if err != nil {
+		return "", err
+	}
+	return location + "?ttl=" + url.QueryEscape(ttl), nil
+}
+
+func (s *weedStore) assign(ttl string) (string, error) {
+	assignUrl := s.masterUrl + "/dir/assign"
+	if ttl != "" {
+		assignUrl += "?ttl=" + url.QueryEscape(ttl)
+	}
+	resp, err := s.client.Post(assignUrl, "text/plain", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var info WeedInfo
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	if err != nil {
+		return "", err
+	}
+	if info.Error != "" {
+		return "", errors.New(info.Error)
+	}
+	// The blob is written right away, so the volume it was assigned to
+	// is remembered rather than looked up again.
+	s.remember(weedVolumeId(info.Fid), []weedLocation{{info.Url, info.PublicUrl}})
+	return info.Fid, nil
+}
+
+// parseWeedLocation splits a location into its fid and ttl. Locations
+// recorded as volume server URLs are reduced to their fid.
+func parseWeedLocation(location string) (fid, ttl string) {
+	if i := strings.Index(location, "?"); i >= 0 {
+		query, _ := url.ParseQuery(location[i+1:])
+		ttl = query.Get("ttl")
+		location = location[:i]
+	}
+	if isWeedUrl(location) {
+		location = location[strings.LastIndex(location, "/")+1:]
+	}
+	return location, ttl
+}
+
+func isWeedUrl(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+func weedVolumeId(fid string) string {
+	if i := strings.Index(fid, ","); i >= 0 {
+		return fid[:i]
+	}
+	return fid
+}
+
+func (s *weedStore) remember(volumeId string, locations []weedLocation) {
+	s.mu.Lock()
+	s.volumes[volumeId] = weedVolume{locations, time.Now().Add(weedLookupTTL)}
+	s.mu.Unlock()
+}
+
+func (s *weedStore) forget(volumeId string) {
+	s.mu.Lock()
+	delete(s.volumes, volumeId)
+	s.mu.Unlock()
+}
+
+// lookup returns the locations of a volume, from the cache unless fresh is
+// set, and whether they came from the cache.
+func (s *weedStore) lookup(volumeId string, fresh bool) ([]weedLocation, bool, error) {
+	if !fresh {
+		s.mu.Lock()
+		volume, ok := s.volumes[volumeId]
+		s.mu.Unlock()
+		if ok && time.Now().Before(volume.expires) {
+			return volume.locations, true, nil
+		}
+	}
+	res, err := s.client.Get(s.masterUrl + "/dir/lookup?volumeId=" + url.QueryEscape(volumeId))
+	if err != nil {
+		return nil, false, err
+	}
+	defer res.Body.Close()
+	var lookup weedLookup
+	err = json.NewDecoder(res.Body).Decode(&lookup)
+	if err != nil {
+		return nil, false, err
+	}
+	if lookup.Error != "" || len(lookup.Locations) == 0 {
+		// The volume is gone, and the blob with it.
+		s.forget(volumeId)
+		return nil, false, errBlobNotFound
+	}
+	s.remember(volumeId, lookup.Locations)
+	return lookup.Locations, false, nil
+}
+
+// do sends a request for the blob at location to each volume server holding
+// it until one answers with neither an error nor a 404 or 5xx status. If
+// all of the cached volume servers fail, the volume is looked up again.
+// The last response is returned when none succeeds.
+func (s *weedStore) do(location string, send func(url string) (*http.Response, error)) (*http.Response, error) {
+	fid, _ := parseWeedLocation(location)
+	volumeId := weedVolumeId(fid)
+	var last *http.Response
+	var lastErr error
+	for fresh := false; ; fresh = true {
+		locations, cached, err := s.lookup(volumeId, fresh)
+		if err != nil {
+			if last != nil {
+				last.Body.Close()
+			}
+			return nil, err
+		}
+		for _, l := range locations {
+			res, err := send("http://" + l.Url + "/" + fid)
+			if err == nil && res.StatusCode != http.StatusNotFound && res.StatusCode < 500 {
+				if last != nil {
+					last.Body.Close()
+				}
+				return res, nil
+			}
+			if last != nil {
+				last.Body.Close()
+			}
+			last, lastErr = res, err
+		}
+		if !cached {
+			break
+		}
+	}
+	if last != nil {
+		return last, nil
+	}
+	return nil, lastErr
+}
+
+// Put writes to one volume server, which replicates the blob. The content
+// cannot be sent twice, so a failure only drops the cached locations.
+func (s *weedStore) Put(location string, name string, r io.Reader) error {
+	fid, ttl := parseWeedLocation(location)
+	locations, _, err := s.lookup(weedVolumeId(fid), false)
+	if err != nil {
+		return err
+	}
+	putUrl := "http://" + locations[0].Url + "/" + fid
+	if ttl != "" {
+		putUrl += "?ttl=" + url.QueryEscape(ttl)
+	}
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		part, err := writer.CreateFormFile("file", name)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		_, err = io.Copy(part, r)
+		if err != nil {
+			writer.Close()
+			pw.CloseWithError(err)
+			return
+		}
+		writer.Close()
+		pw.Close()
+	}()
+	req, err := http.NewRequest("PUT", putUrl, pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	res, err := s.client.Do(req)
+	if err != nil {
+		pr.CloseWithError(err)
+		s.forget(weedVolumeId(fid))
+		return err
+	}
+	defer res.Body.Close()
+	return checkWeedResponse(res)
+}
+
+func (s *weedStore) Get(location string) (*Blob, error) {
+	return s.GetRange(location, 0, -1)
+}
+
+// GetRange asks the volume server for the range, and cuts it out of the
+// whole blob if the server answers with that instead.
+func (s *weedStore) GetRange(location string, offset, length int64) (*Blob, error) {
+	var ranges string
+	if length >= 0 {
+		ranges = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	} else if offset > 0 {
+		ranges = fmt.Sprintf("bytes=%d-", offset)
+	}
+	res, err := s.do(location, func(url string) (*http.Response, error) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if ranges != "" {
+			req.Header.Set("Range", ranges)
+		}
+		return s.client.Do(req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = checkWeedResponse(res)
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	blob := &Blob{weedBlobInfo(res), res.Body}
+	if ranges == "" || res.StatusCode == http.StatusPartialContent {
+		return blob, nil
+	}
+	return cutBlob(blob, offset, length)
+}
+
+// DirectURL is the public URL of a volume server holding the blob, which
+// does not expire, so the volume servers have to be reachable by clients.
+func (s *weedStore) DirectURL(location string, ttl time.Duration, header http.Header) (string, bool, error) {
+	fid, _ := parseWeedLocation(location)
+	locations, _, err := s.lookup(weedVolumeId(fid), false)
+	if err != nil {
+		return "", false, err
+	}
+	host := locations[0].PublicUrl
+	if host == "" {
+		host = locations[0].Url
+	}
+	return "http://" + host + "/" + fid, false, nil
+}
+
+func (s *weedStore) Delete(location string) error {
+	res, err := s.do(location, func(url string) (*http.Response, error) {
+		req, err := http.NewRequest("DELETE", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		return s.client.Do(req)
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return checkWeedResponse(res)
+}
+
+func (s *weedStore) Stat(location string) (*BlobInfo, error) {
+	res, err := s.do(location, s.client.Head)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	err = checkWeedResponse(res)
+	if err != nil {
+		return nil, err
+	}
+	info := weedBlobInfo(res)
+	return &info, nil
+}
+
+func checkWeedResponse(res *http.Response) error {
+	if res.StatusCode == http.StatusNotFound {
+		return errBlobNotFound
+	}
+	if res.StatusCode >= 400 {
+		str, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("weed: %s: %s", res.Status, str)
+	}
+	return nil
+}
+
+func weedBlobInfo(res *http.Response) BlobInfo {
+	info := BlobInfo{ContentType: res.Header.Get("Content-Type")}
+	info.Size, _ = strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	info.ModTime, _ = time.Parse(http.TimeFormat, res.Header.Get("Last-Modified"))
+	return info
+}
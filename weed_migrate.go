@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+)
+
+var (
+	errUpToDate         = errors.New("record up to date")
+	errRedisNotMigrated = errors.New("redis records are not all in the current layout, run -migrate-redis first")
+)
+
+// migrateWeedLocations replaces the volume server URLs recorded as the
+// locations of files, their chunks and their past versions with bare fids,
+// so that they are looked up on the master from then on. It returns the
+// number of records changed. The blob references kept for deduplication
+// hold on to their URLs, which the weed store resolves by fid all the same.
+// Listing skips Redis records in the original layout, so those must have
+// been migrated first.
+func migrateWeedLocations(meta MetadataStore) (int, error) {
+	if store, ok := meta.(*redisStore); ok {
+		migrated, err := store.migrated()
+		if err != nil {
+			return 0, err
+		}
+		if !migrated {
+			return 0, errRedisNotMigrated
+		}
+	}
+	moved := 0
+	for _, trashed := range []bool{false, true} {
+		q := &ListQuery{Trashed: trashed, Limit: maxListLimit}
+		for {
+			list, err := meta.List(q)
+			if err != nil {
+				return moved, err
+			}
+			for _, file := range list.Files {
+				_, err = meta.Update(file.Id, func(file *File) error {
+					if !migrateWeedFile(file) {
+						return errUpToDate
+					}
+					return nil
+				})
+				if err == nil {
+					moved++
+				} else if err != errUpToDate {
+					return moved, err
+				}
+			}
+			if list.Next == "" {
+				break
+			}
+			q.Cursor = list.Next
+		}
+	}
+	return moved, nil
+}
+
+func migrateWeedFile(file *File) bool {
+	changed := migrateWeedLocation(&file.Url)
+	for i := range file.Chunks {
+		changed = migrateWeedLocation(&file.Chunks[i].Url) || changed
+	}
+	for i := range file.Versions {
+		v := &file.Versions[i]
+		changed = migrateWeedLocation(&v.Url) || changed
+		for j := range v.Chunks {
+			changed = migrateWeedLocation(&v.Chunks[j].Url) || changed
+		}
+	}
+	return changed
+}
+
+func migrateWeedLocation(location *string) bool {
+	if !isWeedUrl(*location) {
+		return false
+	}
+	fid, ttl := parseWeedLocation(*location)
+	*location = fid
+	if ttl != "" {
+		*location += "?ttl=" + url.QueryEscape(ttl)
+	}
+	return true
+}
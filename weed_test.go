@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFakeWeed serves one volume holding the blob 3,01 along with a master
+// that looks it up. The volume server only honours Range headers when
+// ranges is set.
+func newFakeWeed(content string, ranges bool) (*httptest.Server, *httptest.Server) {
+	volume := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/3,01" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if ranges {
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.TrimPrefix(volume.URL, "http://")
+		json.NewEncoder(w).Encode(weedLookup{Locations: []weedLocation{{Url: host}}})
+	}))
+	return master, volume
+}
+
+func TestWeedGetRange(t *testing.T) {
+	for _, ranges := range []bool{true, false} {
+		master, volume := newFakeWeed("hello world", ranges)
+		store := newWeedStore(master.URL)
+		for _, c := range []struct {
+			offset, length int64
+			content        string
+		}{
+			{0, -1, "hello world"},
+			{6, -1, "world"},
+			{0, 5, "hello"},
+			{4, 3, "o w"},
+		} {
+			blob, err := store.GetRange("3,01", c.offset, c.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := ioutil.ReadAll(blob)
+			blob.Close()
+			if !bytes.Equal(content, []byte(c.content)) {
+				t.Errorf("ranges %v, GetRange(%d, %d) = %q", ranges, c.offset, c.length, content)
+			}
+		}
+		if _, err := store.GetRange("3,02", 1, 2); err != errBlobNotFound {
+			t.Errorf("missing blob: %v", err)
+		}
+		master.Close()
+		volume.Close()
+	}
+}